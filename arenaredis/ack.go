@@ -0,0 +1,76 @@
+package arenaredis
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+const (
+	defaultAllocationAckMaxAttempts     = 3
+	defaultUnresponsiveContainerPenalty = 30 * time.Second
+	// roomAckTTL is how long an acknowledgement is kept for AllocateRoom waiting for it.
+	roomAckTTL = 1 * time.Minute
+)
+
+var (
+	// rollbackUnacknowledgedAllocationScript releases a room that has not been acknowledged by its container
+	// and penalizes the container. It returns 1 if the room has been acknowledged in the meantime.
+	rollbackUnacknowledgedAllocationScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local container_id = ARGV[2]
+local room_id = ARGV[3]
+local penalty_ms = tonumber(ARGV[4])
+
+if redis.call('HGET', fleet.room_prefix .. room_id, 'acked') == '1' then
+    return 1
+end
+if redis.call('GET', fleet.room_container_prefix .. room_id) == container_id then
+    release_room(fleet, container_id, room_id)
+end
+penalize_container(fleet, container_id, now_ms() + penalty_ms)
+return 0
+`)
+)
+
+// waitForAck waits until the container acknowledges the allocation of the room.
+// If no ack arrives within the timeout, the room is rolled back and false is returned.
+func (a *redisFrontend) waitForAck(ctx context.Context, roomID string, allocated *allocateRoomScriptResult, timeout time.Duration) (bool, error) {
+	roomKey := redisKeyRoom(a.keyPrefix, allocated.FleetName, roomID)
+	res := a.client.Do(ctx, a.client.B().Hget().Key(roomKey).Field("acked").Build())
+	if acked, err := res.ToString(); err == nil && acked == "1" {
+		return true, nil
+	} else if err != nil && !rueidis.IsRedisNil(err) {
+		return false, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to get ack of room: %w", err))
+	}
+
+	ackKey := redisKeyRoomAck(a.keyPrefix, allocated.FleetName, roomID)
+	// A timeout of 0 would make BLPOP block forever
+	res = a.client.Do(ctx, a.client.B().Blpop().Key(ackKey).Timeout(max(timeout, time.Millisecond).Seconds()).Build())
+	if err := res.Error(); err == nil {
+		return true, nil
+	} else if !rueidis.IsRedisNil(err) {
+		return false, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to wait for ack of room: %w", err))
+	}
+
+	// Use a context that is not canceled so that the room is surely rolled back.
+	ctx = context.WithoutCancel(ctx)
+	keys := fleetScriptKeys(a.keyPrefix, allocated.FleetName)
+	penalty := strconv.FormatInt(a.options.unresponsiveContainerPenalty.Milliseconds(), 10)
+	res = rollbackUnacknowledgedAllocationScript.Exec(ctx, a.client, keys, []string{allocated.FleetName, allocated.ContainerID, roomID, penalty})
+	acked, err := res.AsInt64()
+	if err != nil {
+		return false, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to rollback unacknowledged allocation: %w", err))
+	}
+	if acked == 0 {
+		slog.WarnContext(ctx, fmt.Sprintf("container '%s' did not acknowledge room '%s' within %s; rolled back", allocated.ContainerID, roomID, timeout),
+			"fleet", allocated.FleetName, "container", allocated.ContainerID, "room", roomID)
+	}
+	return acked == 1, nil
+}
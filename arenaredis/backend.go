@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 
 	"github.com/redis/rueidis"
@@ -11,6 +12,56 @@ import (
 	"github.com/castaneai/arena"
 )
 
+var (
+	releaseRoomScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+release_room(fleet, ARGV[2], ARGV[3])
+return 0
+`)
+
+	// removeContainerRoomsScript releases all the rooms of a container (e.g. when it is re-added or deleted),
+	// so that the rooms are also removed from the affinity and anti-affinity groups and the indexes.
+	removeContainerRoomsScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local container_id = ARGV[2]
+for _, room_id in ipairs(redis.call('SMEMBERS', fleet.container_to_rooms_prefix .. container_id)) do
+    release_room(fleet, container_id, room_id)
+end
+return 0
+`)
+
+	// ackAllocationScript records the ack of a room and wakes up the AllocateRoom waiting for it.
+	// It returns nil if the room is no longer allocated to the container.
+	ackAllocationScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local container_id = ARGV[2]
+local room_id = ARGV[3]
+local ack_ttl_ms = ARGV[4]
+
+if redis.call('GET', fleet.room_container_prefix .. room_id) ~= container_id then
+    return nil
+end
+redis.call('HSET', fleet.room_prefix .. room_id, 'acked', '1')
+local ack_key = fleet.room_ack_prefix .. room_id
+redis.call('LPUSH', ack_key, '1')
+redis.call('PEXPIRE', ack_key, ack_ttl_ms)
+return 1
+`)
+
+	// setRoomPropertiesScript updates the searchable properties of a room.
+	// It returns nil if the room is no longer allocated to the container.
+	setRoomPropertiesScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local container_id = ARGV[2]
+local room_id = ARGV[3]
+if redis.call('GET', fleet.room_container_prefix .. room_id) ~= container_id then
+    return nil
+end
+set_room_properties(fleet, room_id, cjson.decode(ARGV[4]))
+return 1
+`)
+)
+
 type redisBackend struct {
 	keyPrefix string
 	client    rueidis.Client
@@ -37,6 +88,11 @@ func (b *redisBackend) AddContainer(ctx context.Context, req arena.AddContainerR
 	if req.InitialCapacity < 0 {
 		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("invalid initial capacity"))
 	}
+	for name, amount := range req.Resources {
+		if name == "" || amount < 0 {
+			return nil, arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid resource capacity '%s': %d", name, amount))
+		}
+	}
 
 	// Use default TTL if not specified
 	ttl := req.HeartbeatTTL
@@ -57,11 +113,41 @@ func (b *redisBackend) AddContainer(ctx context.Context, req arena.AddContainerR
 		b.client.B().Zadd().Key(redisKeyAvailableContainersIndex(b.keyPrefix, req.FleetName)).ScoreMember().ScoreMember(float64(req.InitialCapacity), req.ContainerID).Build(),
 		// set initial heartbeat with TTL in value
 		b.client.B().Setex().Key(redisKeyContainerHeartbeat(b.keyPrefix, req.FleetName, req.ContainerID)).Seconds(int64(ttlSeconds)).Value(encodeHeartbeatTTLValue(ttl)).Build(),
+		// replace the container labels
+		b.client.B().Del().Key(redisKeyContainerLabels(b.keyPrefix, req.FleetName, req.ContainerID)).Build(),
+	}
+	if len(req.Labels) > 0 {
+		hset := b.client.B().Hset().Key(redisKeyContainerLabels(b.keyPrefix, req.FleetName, req.ContainerID)).FieldValue()
+		for k, v := range req.Labels {
+			hset = hset.FieldValue(k, v)
+		}
+		cmds = append(cmds, hset.Build())
+	}
+	// replace the container resources
+	cmds = append(cmds, b.client.B().Del().Key(redisKeyContainerResources(b.keyPrefix, req.FleetName, req.ContainerID)).Build())
+	if len(req.Resources) > 0 {
+		hset := b.client.B().Hset().Key(redisKeyContainerResources(b.keyPrefix, req.FleetName, req.ContainerID)).FieldValue()
+		for name, amount := range req.Resources {
+			hset = hset.FieldValue(name, strconv.Itoa(amount))
+		}
+		cmds = append(cmds, hset.Build())
+	}
+	// replace the container topology
+	topologyKey := redisKeyContainerTopology(b.keyPrefix, req.FleetName, req.ContainerID)
+	cmds = append(cmds, b.client.B().Del().Key(topologyKey).Build())
+	if topology := encodeContainerTopology(req.Topology); len(topology) > 0 {
+		hset := b.client.B().Hset().Key(topologyKey).FieldValue()
+		for k, v := range topology {
+			hset = hset.FieldValue(k, v)
+		}
+		cmds = append(cmds, hset.Build())
 	}
+	// wake up the requests waiting for capacity
+	cmds = append(cmds, b.client.B().Publish().Channel(redisPubSubChannelCapacity(b.keyPrefix, req.FleetName)).Message(req.ContainerID).Build())
 
 	if req.InitialCapacity > 0 {
 		// Check if container already exists and clear allocated room mappings
-		if err := b.removeContainerRoomMappings(ctx, req.ContainerID, req.FleetName); err != nil {
+		if err := b.removeContainerRooms(ctx, req.ContainerID, req.FleetName); err != nil {
 			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to remove container rooms: %w", err))
 		}
 	}
@@ -88,6 +174,11 @@ func (b *redisBackend) DeleteContainer(ctx context.Context, req arena.DeleteCont
 		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
 	}
 
+	// release the rooms first, because releasing a room returns its capacity to the index
+	if err := b.removeContainerRooms(ctx, req.ContainerID, req.FleetName); err != nil {
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to remove container rooms: %w", err))
+	}
+
 	// remove the container from the available containers index
 	cmd := b.client.B().Zrem().Key(redisKeyAvailableContainersIndex(b.keyPrefix, req.FleetName)).Member(req.ContainerID).Build()
 	res := b.client.Do(ctx, cmd)
@@ -95,13 +186,12 @@ func (b *redisBackend) DeleteContainer(ctx context.Context, req arena.DeleteCont
 		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to remove container from available containers index: %w", err))
 	}
 
-	if err := b.removeContainerRoomMappings(ctx, req.ContainerID, req.FleetName); err != nil {
-		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to remove container rooms: %w", err))
-	}
-
-	// Remove heartbeat key
+	// Remove heartbeat, labels, resources and topology keys
 	heartbeatKey := redisKeyContainerHeartbeat(b.keyPrefix, req.FleetName, req.ContainerID)
-	cleanupCmd := b.client.B().Del().Key(heartbeatKey).Build()
+	labelsKey := redisKeyContainerLabels(b.keyPrefix, req.FleetName, req.ContainerID)
+	resourcesKey := redisKeyContainerResources(b.keyPrefix, req.FleetName, req.ContainerID)
+	topologyKey := redisKeyContainerTopology(b.keyPrefix, req.FleetName, req.ContainerID)
+	cleanupCmd := b.client.B().Del().Key(heartbeatKey, labelsKey, resourcesKey, topologyKey).Build()
 	if err := b.client.Do(ctx, cleanupCmd).Error(); err != nil {
 		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to delete heartbeat for container '%s': %w", req.ContainerID, err))
 	}
@@ -123,16 +213,11 @@ func (b *redisBackend) ReleaseRoom(ctx context.Context, req arena.ReleaseRoomReq
 		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
 	}
 
-	// increment the capacity of the container in the available containers index
-	cmds := []rueidis.Completed{
-		b.client.B().Zincrby().Key(redisKeyAvailableContainersIndex(b.keyPrefix, req.FleetName)).Increment(1).Member(req.ContainerID).Build(),
-		b.client.B().Srem().Key(redisKeyContainerToRooms(b.keyPrefix, req.FleetName, req.ContainerID)).Member(req.RoomID).Build(),
-		b.client.B().Del().Key(redisKeyRoomToContainer(b.keyPrefix, req.FleetName, req.RoomID)).Build(),
-	}
-	for _, res := range b.client.DoMulti(ctx, cmds...) {
-		if err := res.Error(); err != nil {
-			return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to release room: %w", err))
-		}
+	// increment the capacity and the resources of the container
+	keys := fleetScriptKeys(b.keyPrefix, req.FleetName)
+	res := releaseRoomScript.Exec(ctx, b.client, keys, []string{req.FleetName, req.ContainerID, req.RoomID})
+	if err := res.Error(); err != nil {
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to release room: %w", err))
 	}
 	return nil
 }
@@ -184,6 +269,57 @@ func (b *redisBackend) refreshHeartbeatTTL(ctx context.Context, fleetName, conta
 	return nil
 }
 
+func (b *redisBackend) AckAllocation(ctx context.Context, req arena.AckAllocationRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	if req.ContainerID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing container id"))
+	}
+	if req.FleetName == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	}
+
+	keys := fleetScriptKeys(b.keyPrefix, req.FleetName)
+	res := ackAllocationScript.Exec(ctx, b.client, keys, []string{req.FleetName, req.ContainerID, req.RoomID, strconv.FormatInt(roomAckTTL.Milliseconds(), 10)})
+	if err := res.Error(); err != nil {
+		if rueidis.IsRedisNil(err) {
+			return arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("room '%s' is not allocated to container '%s'", req.RoomID, req.ContainerID))
+		}
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to ack allocation: %w", err))
+	}
+	return nil
+}
+
+func (b *redisBackend) SetRoomProperties(ctx context.Context, req arena.SetRoomPropertiesRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	if req.ContainerID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing container id"))
+	}
+	if req.FleetName == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	}
+	if err := validateRoomProperties(req.Properties); err != nil {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, err)
+	}
+	properties, err := encodeRoomProperties(req.Properties)
+	if err != nil {
+		return arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+
+	keys := fleetScriptKeys(b.keyPrefix, req.FleetName)
+	res := setRoomPropertiesScript.Exec(ctx, b.client, keys, []string{req.FleetName, req.ContainerID, req.RoomID, properties})
+	if err := res.Error(); err != nil {
+		if rueidis.IsRedisNil(err) {
+			return arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("room %s not found in container %s of fleet %s", req.RoomID, req.ContainerID, req.FleetName))
+		}
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to set room properties: %w", err))
+	}
+	return nil
+}
+
 func (b *redisBackend) getOrCreateFleet(name string) *fleet {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -195,22 +331,9 @@ func (b *redisBackend) getOrCreateFleet(name string) *fleet {
 	return f
 }
 
-func (b *redisBackend) removeContainerRoomMappings(ctx context.Context, containerID, fleetName string) error {
-	containerToRoomsKey := redisKeyContainerToRooms(b.keyPrefix, fleetName, containerID)
-	cmd := b.client.B().Smembers().Key(containerToRoomsKey).Build()
-	res := b.client.Do(ctx, cmd)
-	if err := res.Error(); err != nil {
-		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to get rooms for container '%s': %w", containerID, err))
-	}
-	rooms, err := res.AsStrSlice()
-	if err != nil {
-		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to parse rooms as string slice: %w", err))
-	}
-	delCmd := b.client.B().Del().Key(containerToRoomsKey)
-	for _, roomID := range rooms {
-		delCmd.Key(redisKeyRoomToContainer(b.keyPrefix, fleetName, roomID))
-	}
-	return b.client.Do(ctx, delCmd.Build()).Error()
+func (b *redisBackend) removeContainerRooms(ctx context.Context, containerID, fleetName string) error {
+	keys := fleetScriptKeys(b.keyPrefix, fleetName)
+	return removeContainerRoomsScript.Exec(ctx, b.client, keys, []string{fleetName, containerID}).Error()
 }
 
 type fleet struct {
@@ -245,4 +368,3 @@ func (f *fleet) DeleteContainer(containerID string) {
 		delete(f.containers, containerID)
 	}
 }
-
@@ -0,0 +1,304 @@
+package arenaredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+var (
+	// allocateRoomsScript allocates all the rooms or none.
+	// The rooms are placed first, and the AllocationEvents are published only after every room has been placed,
+	// because a published event cannot be taken back.
+	allocateRoomsScript = newLuaScript(`
+local req = cjson.decode(ARGV[1])
+math.randomseed(req.seed)
+local fleets = {}
+for _, fleet in ipairs(load_fleets(req.fleet_names)) do
+    clean_up_fleet(fleet)
+    fleets[fleet.name] = fleet
+end
+
+-- If all the rooms have already been allocated (e.g. a retry after a lost reply), return them as is.
+-- If only some of them have (or are reserved), the request conflicts with other allocations.
+local existing = {}
+local conflicting
+for _, room in ipairs(req.rooms) do
+    local found = false
+    for _, fleet_name in ipairs(room.fleet_names) do
+        local fleet = fleets[fleet_name]
+        local container_id = redis.call('GET', fleet.room_container_prefix .. room.room_id)
+        if container_id then
+            found = true
+            if redis.call('ZSCORE', fleet.reservations_key, room.room_id) then
+                conflicting = conflicting or room.room_id
+            else
+                table.insert(existing, {room_id = room.room_id, container_id = container_id, fleet_name = fleet.name, region = container_region(fleet, container_id), zone = container_zone(fleet, container_id)})
+            end
+            break
+        end
+    end
+    if not found and room.global_room_registry and registered_fleet(fleets[room.fleet_names[1]], room.room_id) then
+        conflicting = conflicting or room.room_id
+    end
+end
+if not conflicting and #existing == #req.rooms then
+    return cjson.encode({rooms = existing})
+end
+if conflicting or #existing > 0 then
+    return cjson.encode({already_allocated = conflicting or existing[1].room_id})
+end
+
+-- Containers found to be unsubscribed in this allocation
+local suspects = {}
+-- Rooms placed so far: {fleet, container_id, room}
+local placed = {}
+-- The room that could not be placed because of its anti-affinity rule, if any (see allocateRoomScript)
+local anti_affinity_room_id
+
+local function rejected_by_anti_affinity(rejections)
+    for _, rejection in ipairs(rejections) do
+        if rejection.reason == 'anti_affinity' then
+            return true
+        end
+    end
+    return false
+end
+
+local function copy(t)
+    local c = {}
+    for k, v in pairs(t) do
+        c[k] = v
+    end
+    return c
+end
+
+local function room_fleets(room)
+    local result = {}
+    for _, fleet_name in ipairs(room.fleet_names) do
+        table.insert(result, fleets[fleet_name])
+    end
+    return result
+end
+
+local function place(fleet, container_id, room)
+    place_room(fleet, container_id, room)
+    table.insert(placed, {fleet = fleet, container_id = container_id, room = room})
+end
+
+local function undo()
+    for i = #placed, 1, -1 do
+        local p = placed[i]
+        release_room(p.fleet, p.container_id, p.room.room_id)
+    end
+    placed = {}
+end
+
+-- place_each places the rooms one by one; if distinct, each on a container not used by the others.
+local function place_each(distinct)
+    local excluded = copy(suspects)
+    for _, room in ipairs(req.rooms) do
+        local found = false
+        local rejections = {}
+        for _, target in ipairs(search_order(room_fleets(room), room)) do
+            local fleet = target.fleet
+            room.region = target.region
+            local container_id = is_turn(fleet, nil) and find_container(fleet, room, excluded, rejections)
+            if container_id then
+                place(fleet, container_id, room)
+                if distinct then
+                    excluded[fleet.name .. ':' .. container_id] = true
+                end
+                found = true
+                break
+            end
+        end
+        if not found then
+            if rejected_by_anti_affinity(rejections) then
+                anti_affinity_room_id = room.room_id
+            end
+            return false
+        end
+    end
+    return true
+end
+
+-- place_together places all the rooms on a single container.
+local function place_together()
+    local excluded = copy(suspects)
+    local first = req.rooms[1]
+    local rejections = {}
+    local violated_room_id
+    for _, target in ipairs(search_order(room_fleets(first), first)) do
+        local fleet = target.fleet
+        first.region = target.region
+        local container_id = is_turn(fleet, nil) and find_container(fleet, first, excluded, rejections)
+        while container_id do
+            place(fleet, container_id, first)
+            local fits = true
+            for i = 2, #req.rooms do
+                local reason = rejection_reason(fleet, container_id, req.rooms[i])
+                if reason then
+                    if reason == 'anti_affinity' then
+                        violated_room_id = violated_room_id or req.rooms[i].room_id
+                    end
+                    fits = false
+                    break
+                end
+                place(fleet, container_id, req.rooms[i])
+            end
+            if fits then
+                return true
+            end
+            undo()
+            excluded[fleet.name .. ':' .. container_id] = true
+            container_id = find_container(fleet, first, excluded, rejections)
+        end
+    end
+    if rejected_by_anti_affinity(rejections) then
+        violated_room_id = first.room_id
+    end
+    anti_affinity_room_id = violated_room_id
+    return false
+end
+
+while true do
+    local ok
+    if req.placement == 'same_container' then
+        ok = place_together()
+    else
+        ok = place_each(req.placement == 'distinct_containers')
+    end
+    if not ok then
+        undo()
+        if anti_affinity_room_id then
+            return cjson.encode({anti_affinity_violated = anti_affinity_room_id})
+        end
+        return nil
+    end
+
+    -- Make sure every container is subscribed to its events before publishing any of them (see allocateRoomScript)
+    local unsubscribed = false
+    for _, p in ipairs(placed) do
+        local key = p.fleet.name .. ':' .. p.container_id
+        if not suspects[key] and redis.call('PUBSUB', 'NUMSUB', p.fleet.container_channel_prefix .. p.container_id)[2] == 0 then
+            suspects[key] = true
+            penalize_container(p.fleet, p.container_id, now_ms() + req.penalty_ms)
+            unsubscribed = true
+        end
+    end
+    if not unsubscribed then
+        break
+    end
+    undo()
+end
+
+local results = {}
+for _, p in ipairs(placed) do
+    redis.call('HSET', p.fleet.room_prefix .. p.room.room_id, 'state', 'allocated')
+    redis.call('PUBLISH', p.fleet.container_channel_prefix .. p.container_id, p.room.allocation_event)
+    table.insert(results, {container_id = p.container_id, fleet_name = p.fleet.name, region = container_region(p.fleet, p.container_id), zone = container_zone(p.fleet, p.container_id)})
+end
+return cjson.encode({rooms = results})
+`)
+)
+
+func (a *redisFrontend) AllocateRooms(ctx context.Context, req arena.AllocateRoomsRequest) (*arena.AllocateRoomsResponse, error) {
+	if err := validateAllocateRoomsRequest(req); err != nil {
+		return nil, err
+	}
+
+	placement := req.Placement
+	if placement == "" {
+		placement = arena.RoomPlacementAny
+	}
+	scriptReq := allocateRoomsScriptRequest{
+		Placement: string(placement),
+		Seed:      rand.Int64N(math.MaxInt32),
+		PenaltyMs: a.options.unresponsiveContainerPenalty.Milliseconds(),
+	}
+	for _, room := range req.Rooms {
+		roomReq, err := a.newAllocateRoomScriptRequest(room)
+		if err != nil {
+			return nil, err
+		}
+		scriptReq.Rooms = append(scriptReq.Rooms, roomReq)
+		for _, fleetName := range roomReq.FleetNames {
+			if !slices.Contains(scriptReq.FleetNames, fleetName) {
+				scriptReq.FleetNames = append(scriptReq.FleetNames, fleetName)
+			}
+		}
+	}
+	encodedReq, err := encodeAllocateRoomsScriptRequest(scriptReq)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation request: %w", err))
+	}
+	res := allocateRoomsScript.Exec(ctx, a.client, multiFleetScriptKeys(a.keyPrefix, scriptReq.FleetNames), []string{encodedReq})
+	if err := res.Error(); err != nil {
+		if rueidis.IsRedisNil(err) {
+			return nil, arena.NewError(arena.ErrorStatusResourceExhausted, errors.New("no available containers for all the rooms"))
+		}
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to allocate rooms: %w", err))
+	}
+	data, err := res.ToString()
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to parse redis result as string: %w", err))
+	}
+	result, err := decodeAllocateRoomsScriptResult(data)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+	if result.AlreadyAllocated != "" {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("room %s has already been allocated", result.AlreadyAllocated))
+	}
+	if result.AntiAffinityViolated != "" {
+		for _, room := range req.Rooms {
+			if room.RoomID == result.AntiAffinityViolated {
+				return nil, arena.NewError(arena.ErrorStatusUnsatisfiable, fmt.Errorf("every available container already hosts a room of anti-affinity group '%s' (room %s)", room.AntiAffinityGroup, room.RoomID))
+			}
+		}
+	}
+
+	resp := &arena.AllocateRoomsResponse{}
+	for i, room := range result.Rooms {
+		resp.Rooms = append(resp.Rooms, arena.AllocateRoomResponse{RoomID: req.Rooms[i].RoomID, ContainerID: room.ContainerID, FleetName: room.FleetName, Region: room.Region, Zone: room.Zone,
+			PreferredContainerHonored: isPreferredContainer(req.Rooms[i], &room)})
+	}
+	return resp, nil
+}
+
+func validateAllocateRoomsRequest(req arena.AllocateRoomsRequest) error {
+	if len(req.Rooms) == 0 {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing rooms"))
+	}
+	switch req.Placement {
+	case "", arena.RoomPlacementAny, arena.RoomPlacementSameContainer, arena.RoomPlacementDistinctContainers:
+	default:
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("unknown room placement '%s'", req.Placement))
+	}
+	roomIDs := make(map[string]struct{}, len(req.Rooms))
+	for _, room := range req.Rooms {
+		if err := validateAllocateRoomRequest(room); err != nil {
+			return err
+		}
+		if room.WaitForCapacity || room.AckTimeout > 0 {
+			return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("WaitForCapacity and AckTimeout are not supported by AllocateRooms"))
+		}
+		if _, ok := roomIDs[room.RoomID]; ok {
+			return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("duplicate room id '%s'", room.RoomID))
+		}
+		roomIDs[room.RoomID] = struct{}{}
+		if req.Placement == arena.RoomPlacementSameContainer &&
+			(room.FleetName != req.Rooms[0].FleetName || !slices.Equal(room.FallbackFleetNames, req.Rooms[0].FallbackFleetNames)) {
+			return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("rooms placed on the same container must have the same fleets"))
+		}
+	}
+	return nil
+}
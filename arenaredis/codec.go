@@ -15,6 +15,9 @@ import (
 const (
 	toContainerEventNameAllocationEvent   = "AllocationEvent"
 	toContainerEventNameNotifyToRoomEvent = "NotifyToRoomEvent"
+	// RoomPreemptedEvent is encoded by allocateRoomScript
+	toContainerEventNameRoomPreemptedEvent   = "RoomPreemptedEvent"
+	toContainerEventNameRoomDeallocatedEvent = "RoomDeallocatedEvent"
 )
 
 type allocationEventJSON struct {
@@ -22,11 +25,31 @@ type allocationEventJSON struct {
 	RoomInitialData string `json:"room_initial_data,omitempty"`
 }
 
+type labelSelectorJSON struct {
+	MatchLabels      map[string]string              `json:"match_labels,omitempty"`
+	MatchExpressions []labelSelectorRequirementJSON `json:"match_expressions,omitempty"`
+}
+
+type labelSelectorRequirementJSON struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
 type notifyToRoomEventJSON struct {
 	RoomID string `json:"room_id"`
 	Body   string `json:"body"`
 }
 
+type roomPreemptedEventJSON struct {
+	RoomID        string `json:"room_id"`
+	GracePeriodMs int64  `json:"grace_period_ms"`
+}
+
+type roomDeallocatedEventJSON struct {
+	RoomID string `json:"room_id"`
+}
+
 func encodeAllocationEvent(roomID string, roomInitialData []byte) (string, error) {
 	j := allocationEventJSON{
 		RoomID:          roomID,
@@ -51,6 +74,216 @@ func encodeNotifyToRoomEvent(roomID string, body []byte) (string, error) {
 	return toContainerEventNameNotifyToRoomEvent + ":" + rueidis.BinaryString(bytes), nil
 }
 
+func encodeRoomDeallocatedEvent(roomID string) (string, error) {
+	bytes, err := json.Marshal(roomDeallocatedEventJSON{RoomID: roomID})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode RoomDeallocatedEvent: %w", err)
+	}
+	return toContainerEventNameRoomDeallocatedEvent + ":" + rueidis.BinaryString(bytes), nil
+}
+
+func newLabelSelectorJSON(selector arena.LabelSelector) labelSelectorJSON {
+	j := labelSelectorJSON{
+		MatchLabels: selector.MatchLabels,
+	}
+	for _, req := range selector.MatchExpressions {
+		j.MatchExpressions = append(j.MatchExpressions, labelSelectorRequirementJSON{
+			Key:      req.Key,
+			Operator: string(req.Operator),
+			Values:   req.Values,
+		})
+	}
+	return j
+}
+
+// allocateRoomScriptRequest is the parameter of allocateRoomScript.
+// Note that nil maps and slices must be omitted or encoded as empty ones, because JSON null is decoded into cjson.null in Lua.
+type allocateRoomScriptRequest struct {
+	RoomID          string            `json:"room_id"`
+	FleetNames      []string          `json:"fleet_names"`
+	AllocationEvent string            `json:"allocation_event"`
+	CandidateCount  int               `json:"candidate_count"`
+	LabelSelector   labelSelectorJSON `json:"label_selector"`
+	Resources       map[string]int    `json:"resources"`
+	Strategy        string            `json:"strategy"`
+	Seed            int64             `json:"seed"`
+	TicketID        string            `json:"ticket_id,omitempty"`
+	AffinityKey     string            `json:"affinity_key,omitempty"`
+	// AntiAffinityGroup and AntiAffinityTopologyKey are omitted if empty, so that they are nil in Lua
+	AntiAffinityGroup       string            `json:"anti_affinity_group,omitempty"`
+	AntiAffinityTopologyKey string            `json:"anti_affinity_topology_key,omitempty"`
+	PreferredZones          []string          `json:"preferred_zones,omitempty"`
+	PreferredRegions        []string          `json:"preferred_regions,omitempty"`
+	Exclusive               bool              `json:"exclusive,omitempty"`
+	TopK                    int               `json:"top_k,omitempty"`
+	TopKWeighting           string            `json:"top_k_weighting,omitempty"`
+	Priority                int               `json:"priority,omitempty"`
+	PreferredContainerID    string            `json:"preferred_container_id,omitempty"`
+	Properties              map[string]string `json:"properties,omitempty"`
+	// GlobalRoomRegistry makes the script record the room in the registry shared by all the fleets
+	GlobalRoomRegistry bool `json:"global_room_registry,omitempty"`
+	// PreemptionGracePeriodMs is sent to the container of a preempted room (see RoomPreemptedEvent)
+	PreemptionGracePeriodMs int64 `json:"preemption_grace_period_ms,omitempty"`
+	// ReservationTTLMs makes the script reserve the room instead of allocating it
+	ReservationTTLMs int64 `json:"reservation_ttl_ms,omitempty"`
+	// PenaltyMs is how long a container that is not subscribed to its events is excluded from allocation
+	PenaltyMs int64 `json:"penalty_ms"`
+	// ScanLimit is how many candidates find_container scans at most, or 0 (omitted) for no limit
+	ScanLimit int `json:"scan_limit,omitempty"`
+	// AntiAffinityTopology is the field of the container topology for a well-known AntiAffinityTopologyKey (see topologyKeyFields)
+	AntiAffinityTopology string `json:"anti_affinity_topology_field,omitempty"`
+	// DryRun makes find_container leave the state as is (see ExplainAllocation)
+	DryRun bool `json:"dry_run,omitempty"`
+	// UseSelected makes the script try only the Selected containers (see ContainerSelector)
+	UseSelected bool                    `json:"use_selected,omitempty"`
+	Selected    []selectedContainerJSON `json:"selected,omitempty"`
+}
+
+// selectedContainerJSON is a container chosen by ContainerSelector with its capacity in the snapshot.
+type selectedContainerJSON struct {
+	FleetName   string `json:"fleet_name"`
+	ContainerID string `json:"container_id"`
+	Capacity    int    `json:"capacity"`
+}
+
+// containerCandidateJSON is a candidate container in the snapshot taken by snapshotContainerCandidatesScript.
+type containerCandidateJSON struct {
+	FleetName   string            `json:"fleet_name"`
+	ContainerID string            `json:"container_id"`
+	Capacity    int               `json:"capacity"`
+	RoomCount   int               `json:"room_count"`
+	Labels      map[string]string `json:"labels"`
+	Resources   map[string]int    `json:"resources"`
+	Region      string            `json:"region"`
+	Zone        string            `json:"zone"`
+	Host        string            `json:"host"`
+}
+
+type allocateRoomScriptResult struct {
+	ContainerID     string `json:"container_id"`
+	FleetName       string `json:"fleet_name"`
+	Region          string `json:"region,omitempty"`
+	Zone            string `json:"zone,omitempty"`
+	ReservedUntilMs int64  `json:"reserved_until_ms,omitempty"`
+	// AntiAffinityViolated is set (and the room is not allocated) if only the anti-affinity rule prevented the allocation
+	AntiAffinityViolated bool `json:"anti_affinity_violated,omitempty"`
+	// Conflict is set (and the room is not allocated) if a selected container has changed since the snapshot
+	Conflict bool `json:"conflict,omitempty"`
+	// AlreadyAllocated is set by explainAllocationScript if the room has already been allocated
+	AlreadyAllocated bool `json:"already_allocated,omitempty"`
+	// PreemptedRoomID is the room released to make room for the allocation, if any, with its priority
+	PreemptedRoomID   string `json:"preempted_room_id,omitempty"`
+	PreemptedPriority int    `json:"preempted_priority,omitempty"`
+	// Reserved is set (and the room is not allocated) if the room to allocate has been reserved by ReserveRoom
+	Reserved bool `json:"reserved,omitempty"`
+	// RegisteredFleet is set (and the room is not allocated) if the room ID is used in another fleet (see WithGlobalRoomRegistry)
+	RegisteredFleet string `json:"registered_fleet,omitempty"`
+}
+
+// allocateRoomsScriptRequest is the parameter of allocateRoomsScript.
+type allocateRoomsScriptRequest struct {
+	// Rooms are the rooms to allocate; Seed, TicketID, ReservationTTLMs and PenaltyMs of each room are not used.
+	Rooms []allocateRoomScriptRequest `json:"rooms"`
+	// FleetNames are the fleets of all the rooms, in the order of the script keys
+	FleetNames []string `json:"fleet_names"`
+	Placement  string   `json:"placement"`
+	Seed       int64    `json:"seed"`
+	PenaltyMs  int64    `json:"penalty_ms"`
+}
+
+type allocateRoomsScriptResult struct {
+	Rooms []allocateRoomScriptResult `json:"rooms"`
+	// AlreadyAllocated is the room ID that has already been allocated, if any; no room is allocated then.
+	AlreadyAllocated string `json:"already_allocated,omitempty"`
+	// AntiAffinityViolated is the room ID that could not be placed only because of its anti-affinity rule, if any;
+	// no room is allocated then.
+	AntiAffinityViolated string `json:"anti_affinity_violated,omitempty"`
+}
+
+type explainAllocationScriptResult struct {
+	Chosen     *allocateRoomScriptResult `json:"chosen"`
+	Rejections []candidateRejectionJSON  `json:"rejections"`
+}
+
+type getRoomScriptResult struct {
+	ContainerID     string `json:"container_id"`
+	State           string `json:"state"`
+	AllocatedAtMs   int64  `json:"allocated_at_ms"`
+	AllocationEvent string `json:"allocation_event"`
+	NowMs           int64  `json:"now_ms"`
+	ContainerAlive  bool   `json:"container_alive"`
+}
+
+type candidateRejectionJSON struct {
+	FleetName   string `json:"fleet_name"`
+	ContainerID string `json:"container_id"`
+	Reason      string `json:"reason"`
+}
+
+func encodeAllocateRoomScriptRequest(req allocateRoomScriptRequest) (string, error) {
+	if req.Resources == nil {
+		req.Resources = map[string]int{}
+	}
+	bytes, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode allocateRoomScript request: %w", err)
+	}
+	return string(bytes), nil
+}
+
+func decodeAllocateRoomScriptResult(data string) (*allocateRoomScriptResult, error) {
+	var result allocateRoomScriptResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, fmt.Errorf("failed to decode allocateRoomScript result: %w", err)
+	}
+	return &result, nil
+}
+
+func encodeAllocateRoomsScriptRequest(req allocateRoomsScriptRequest) (string, error) {
+	for i := range req.Rooms {
+		if req.Rooms[i].Resources == nil {
+			req.Rooms[i].Resources = map[string]int{}
+		}
+	}
+	bytes, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode allocateRoomsScript request: %w", err)
+	}
+	return string(bytes), nil
+}
+
+func decodeAllocateRoomsScriptResult(data string) (*allocateRoomsScriptResult, error) {
+	var result allocateRoomsScriptResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, fmt.Errorf("failed to decode allocateRoomsScript result: %w", err)
+	}
+	return &result, nil
+}
+
+func decodeExplainAllocationScriptResult(data string) (*explainAllocationScriptResult, error) {
+	var result explainAllocationScriptResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, fmt.Errorf("failed to decode explainAllocationScript result: %w", err)
+	}
+	return &result, nil
+}
+
+func decodeGetRoomScriptResult(data string) (*getRoomScriptResult, error) {
+	var result getRoomScriptResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, fmt.Errorf("failed to decode getRoomScript result: %w", err)
+	}
+	return &result, nil
+}
+
+func decodeContainerCandidates(data string) ([]containerCandidateJSON, error) {
+	var candidates []containerCandidateJSON
+	if err := json.Unmarshal([]byte(data), &candidates); err != nil {
+		return nil, fmt.Errorf("failed to decode container candidates: %w", err)
+	}
+	return candidates, nil
+}
+
 func decodeToContainerEvent(data string) (arena.ToContainerEvent, error) {
 	parts := strings.SplitN(data, ":", 2)
 	if len(parts) != 2 {
@@ -96,11 +329,118 @@ func decodeToContainerEvent(data string) (arena.ToContainerEvent, error) {
 		}
 		result.Body = b
 		return result, nil
+	case toContainerEventNameRoomPreemptedEvent:
+		var j roomPreemptedEventJSON
+		if err := json.Unmarshal([]byte(body), &j); err != nil {
+			return nil, fmt.Errorf("failed to decode RoomPreemptedEvent: %w", err)
+		}
+		if j.RoomID == "" {
+			return nil, fmt.Errorf("failed to decode RoomPreemptedEvent: missing room_id")
+		}
+		return &arena.RoomPreemptedEvent{
+			RoomID:      j.RoomID,
+			GracePeriod: time.Duration(j.GracePeriodMs) * time.Millisecond,
+		}, nil
+	case toContainerEventNameRoomDeallocatedEvent:
+		var j roomDeallocatedEventJSON
+		if err := json.Unmarshal([]byte(body), &j); err != nil {
+			return nil, fmt.Errorf("failed to decode RoomDeallocatedEvent: %w", err)
+		}
+		if j.RoomID == "" {
+			return nil, fmt.Errorf("failed to decode RoomDeallocatedEvent: missing room_id")
+		}
+		return &arena.RoomDeallocatedEvent{RoomID: j.RoomID}, nil
 	default:
 		return nil, fmt.Errorf("failed to decode toContainer event: unknown event name '%s'", eventName)
 	}
 }
 
+// encodeRoomProperties encodes the properties passed to set_room_properties in Lua.
+func encodeRoomProperties(properties map[string]string) (string, error) {
+	if properties == nil {
+		properties = map[string]string{}
+	}
+	bytes, err := json.Marshal(properties)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode room properties: %w", err)
+	}
+	return string(bytes), nil
+}
+
+// roomSearchCursor is the last room returned by SearchRooms.
+type roomSearchCursor struct {
+	RoomID string `json:"room_id"`
+	// SortValue is the SortBy property of the room, or nil if it is missing or not a number
+	SortValue *string `json:"sort_value,omitempty"`
+}
+
+func encodeRoomSearchCursor(cursor roomSearchCursor) string {
+	bytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// decodeRoomSearchCursor returns nil for the first page.
+func decodeRoomSearchCursor(data string) (*roomSearchCursor, error) {
+	if data == "" {
+		return nil, nil
+	}
+	bytes, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	var cursor roomSearchCursor
+	if err := json.Unmarshal(bytes, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return &cursor, nil
+}
+
+// roomListCursor is the position in the listing of rooms (see Metrics.ListRooms).
+type roomListCursor struct {
+	// ScanCursor is the SSCAN cursor when listing the rooms of a container
+	ScanCursor uint64 `json:"scan_cursor,omitempty"`
+	// AllocatedAtMs and RoomID are the last room listed when listing the rooms by allocation time
+	AllocatedAtMs int64  `json:"allocated_at_ms,omitempty"`
+	RoomID        string `json:"room_id,omitempty"`
+}
+
+func encodeRoomListCursor(cursor roomListCursor) string {
+	bytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeRoomListCursor(data string) (roomListCursor, error) {
+	var cursor roomListCursor
+	if data == "" {
+		return cursor, nil
+	}
+	bytes, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := json.Unmarshal(bytes, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// topologyKeyFields maps the well-known topology keys to the fields of the container topology hash.
+var topologyKeyFields = map[string]string{
+	arena.TopologyKeyHost: "host",
+	arena.TopologyKeyZone: "zone",
+}
+
+// encodeContainerTopology returns the non-empty fields of the topology as the fields of the topology hash.
+func encodeContainerTopology(topology arena.ContainerTopology) map[string]string {
+	fields := map[string]string{}
+	for k, v := range map[string]string{"region": topology.Region, "zone": topology.Zone, "host": topology.Host} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
 func encodeHeartbeatTTLValue(ttl time.Duration) string {
 	return fmt.Sprintf("alive:%d", int(ttl.Seconds()))
 }
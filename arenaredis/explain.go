@@ -0,0 +1,155 @@
+package arenaredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/castaneai/arena"
+)
+
+var (
+	// explainAllocationScript runs the selection of allocateRoomScript without changing anything,
+	// and returns the chosen container and the rejected candidates with the reason.
+	// The rooms due for reaping (see clean_up_fleet) are regarded as released, as allocateRoomScript would release them first.
+	explainAllocationScript = newLuaScript(`
+local req = cjson.decode(ARGV[1])
+math.randomseed(req.seed)
+req.dry_run = true
+local fleets = load_fleets(req.fleet_names)
+
+for _, fleet in ipairs(fleets) do
+    local container_id = redis.call('GET', fleet.room_container_prefix .. req.room_id)
+    local reserved_until = tonumber(redis.call('ZSCORE', fleet.reservations_key, req.room_id))
+    if container_id and not (reserved_until and reserved_until <= now_ms()) then
+        return cjson.encode({chosen = {container_id = container_id, fleet_name = fleet.name, region = container_region(fleet, container_id), zone = container_zone(fleet, container_id), already_allocated = true}})
+    end
+end
+
+req.released = {}
+for _, fleet in ipairs(fleets) do
+    released_by_reaping(fleet, req.released)
+end
+
+-- find_released_container returns a container that has no capacity left, and therefore is not a candidate of find_container,
+-- but could host the room once the rooms due for reaping are released.
+local function find_released_container(fleet, rejections)
+    local prefix = fleet.name .. ':'
+    local container_ids = {}
+    for key, released in pairs(req.released) do
+        local container_id = string.sub(key, #prefix + 1)
+        if string.sub(key, 1, #prefix) == prefix and released.slots > 0
+            and (tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id)) or 0) <= 0 then
+            table.insert(container_ids, container_id)
+        end
+    end
+    table.sort(container_ids)
+    for _, container_id in ipairs(container_ids) do
+        local reason = rejection_reason(fleet, container_id, req)
+        if not reason then
+            return container_id
+        end
+        table.insert(rejections, {fleet_name = fleet.name, container_id = container_id, reason = reason})
+    end
+    return nil
+end
+
+local rejections = {}
+local chosen
+for _, target in ipairs(search_order(fleets, req)) do
+    local fleet = target.fleet
+    req.region = target.region
+    if not is_turn(fleet, nil, true) then
+        table.insert(rejections, {fleet_name = fleet.name, container_id = '', reason = 'waiting_requests'})
+    else
+        local container_id = find_container(fleet, req, {}, rejections) or find_released_container(fleet, rejections)
+        if container_id then
+            chosen = {container_id = container_id, fleet_name = fleet.name, region = container_region(fleet, container_id), zone = container_zone(fleet, container_id)}
+            break
+        end
+    end
+end
+-- No container can host the room: a room of lower priority would be preempted (see allocateRoomScript)
+if not chosen then
+    for _, target in ipairs(search_order(fleets, req)) do
+        local fleet = target.fleet
+        req.region = target.region
+        local victim = is_turn(fleet, nil, true) and find_preemption_victim(fleet, req, {})
+        if victim then
+            chosen = {container_id = victim.container_id, fleet_name = fleet.name, region = container_region(fleet, victim.container_id), zone = container_zone(fleet, victim.container_id),
+                preempted_room_id = victim.room_id, preempted_priority = victim.priority}
+            break
+        end
+    end
+end
+-- Containers without capacity are not even candidates, unless they would get capacity back by reaping
+for _, fleet in ipairs(fleets) do
+    for _, container_id in ipairs(redis.call('ZRANGE', fleet.available_containers_key, '-inf', '0', 'BYSCORE', 'LIMIT', '0', req.candidate_count)) do
+        local released = released_of(fleet, container_id, req)
+        if not (released and released.slots > 0) then
+            table.insert(rejections, {fleet_name = fleet.name, container_id = container_id, reason = 'no_capacity'})
+        end
+    end
+end
+
+-- A container can be checked several times (e.g. once per region); keep the last reason, except for the chosen one
+local latest = {}
+local order = {}
+for _, rejection in ipairs(rejections) do
+    local key = rejection.fleet_name .. ':' .. rejection.container_id
+    if not latest[key] then
+        table.insert(order, key)
+    end
+    latest[key] = rejection
+end
+local result = {}
+for _, key in ipairs(order) do
+    if not (chosen and key == chosen.fleet_name .. ':' .. chosen.container_id) then
+        table.insert(result, latest[key])
+    end
+end
+-- Empty tables are omitted because they may be encoded as JSON objects; found keeps the result from being empty
+return cjson.encode({found = chosen ~= nil, chosen = chosen, rejections = #result > 0 and result or nil})
+`)
+)
+
+func (a *redisFrontend) ExplainAllocation(ctx context.Context, req arena.AllocateRoomRequest) (*arena.ExplainAllocationResponse, error) {
+	if err := validateAllocateRoomRequest(req); err != nil {
+		return nil, err
+	}
+
+	scriptReq, err := a.newAllocateRoomScriptRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	encodedReq, err := encodeAllocateRoomScriptRequest(scriptReq)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation request: %w", err))
+	}
+	res := explainAllocationScript.Exec(ctx, a.client, multiFleetScriptKeys(a.keyPrefix, scriptReq.FleetNames), []string{encodedReq})
+	data, err := res.ToString()
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to explain allocation: %w", err))
+	}
+	result, err := decodeExplainAllocationScriptResult(data)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+
+	resp := &arena.ExplainAllocationResponse{}
+	if result.Chosen != nil {
+		resp.ContainerID = result.Chosen.ContainerID
+		resp.FleetName = result.Chosen.FleetName
+		resp.Region = result.Chosen.Region
+		resp.Zone = result.Chosen.Zone
+		resp.AlreadyAllocated = result.Chosen.AlreadyAllocated
+		resp.PreemptedRoomID = result.Chosen.PreemptedRoomID
+	}
+	for _, rejection := range result.Rejections {
+		resp.Rejections = append(resp.Rejections, arena.CandidateRejection{
+			ContainerID: rejection.ContainerID,
+			FleetName:   rejection.FleetName,
+			Reason:      arena.RejectionReason(rejection.Reason),
+		})
+	}
+	return resp, nil
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"strconv"
+	"time"
 
 	"github.com/redis/rueidis"
 
@@ -12,54 +16,218 @@ import (
 )
 
 const (
-	defaultCandidateContainerMaxCount = 100
+	defaultCandidateContainerMaxCount  = 100
+	defaultCandidateContainerScanLimit = 1000
+	defaultPreemptionGracePeriod       = 30 * time.Second
 )
 
 var (
-	allocateRoomScript = rueidis.NewLuaScript(`
-local room_container_key = KEYS[1]
-local container_id = redis.call('GET', room_container_key)
-if container_id then
-	return container_id
+	allocateRoomScript = newLuaScript(`
+local req = cjson.decode(ARGV[1])
+math.randomseed(req.seed)
+local fleets = load_fleets(req.fleet_names)
+
+for _, fleet in ipairs(fleets) do
+    clean_up_fleet(fleet)
+end
+
+-- If the room is already allocated in any of the fleets, return it as is.
+-- A reserved room is not regarded as allocated, because its container has not been notified yet.
+for _, fleet in ipairs(fleets) do
+    local container_id = redis.call('GET', fleet.room_container_prefix .. req.room_id)
+    if container_id then
+        local reserved_until = redis.call('ZSCORE', fleet.reservations_key, req.room_id)
+        if reserved_until and not req.reservation_ttl_ms then
+            return cjson.encode({reserved = true, fleet_name = fleet.name})
+        end
+        return cjson.encode({container_id = container_id, fleet_name = fleet.name, region = container_region(fleet, container_id), zone = container_zone(fleet, container_id), reserved_until_ms = tonumber(reserved_until)})
+    end
+end
+
+-- With the global room registry, the room ID must be unique across all the fleets
+if req.global_room_registry then
+    local owner = registered_fleet(fleets[1], req.room_id)
+    if owner then
+        return cjson.encode({registered_fleet = owner})
+    end
 end
 
-local available_containers_key = KEYS[2]
-local heartbeat_prefix = KEYS[5]
-local candidate_container_max_count = ARGV[4]
+-- Containers found to be unsubscribed in this allocation
+local suspects = {}
+-- Candidates that cannot host the room, to tell why the room was not allocated
+local rejections = {}
 
--- Find containers that have vacancy in capacity
-local found = redis.call('ZRANGE', available_containers_key, '(0', '+inf', 'BYSCORE', 'LIMIT', '0', candidate_container_max_count)
-if #found == 0 then
+-- With a ContainerSelector, only the selected containers are tried in the ranked order,
+-- as long as their capacity has not changed since the snapshot (optimistic check-and-set).
+local conflict = false
+local function choose_container(fleet)
+    if not req.use_selected then
+        return find_container(fleet, req, suspects, rejections)
+    end
+    for _, selected in ipairs(req.selected or {}) do
+        if selected.fleet_name == fleet.name and not suspects[fleet.name .. ':' .. selected.container_id] then
+            if tonumber(redis.call('ZSCORE', fleet.available_containers_key, selected.container_id)) ~= selected.capacity then
+                conflict = true
+                return nil
+            end
+            if can_host(fleet, selected.container_id, req) then
+                return selected.container_id
+            end
+        end
+    end
     return nil
 end
 
--- Check heartbeat for each container and find first alive one
-for i, candidate_id in ipairs(found) do
-    local heartbeat_key = heartbeat_prefix .. candidate_id
-    if redis.call('EXISTS', heartbeat_key) == 1 then
-        container_id = candidate_id
-        break
-    else
-        -- Remove dead container from available containers
-        redis.call('ZREM', available_containers_key, candidate_id)
+-- commit_allocation records the room allocated to the container and returns the result
+local function commit_allocation(fleet, container_id, reserved_until, preempted)
+    place_room(fleet, container_id, req)
+
+    -- Leave the queue (of the primary fleet) and let the next waiter try the remaining capacity
+    if req.ticket_id then
+        local queue_fleet = fleets[1]
+        local finish = redis.call('ZSCORE', queue_fleet.allocation_queue_key, req.ticket_id)
+        redis.call('ZREM', queue_fleet.allocation_queue_key, req.ticket_id)
+        redis.call('DEL', queue_fleet.allocation_ticket_prefix .. req.ticket_id)
+        if redis.call('EXISTS', queue_fleet.allocation_queue_key) == 1 then
+            -- Advance the virtual time to the served ticket (see enqueueAllocationTicketScript)
+            if finish then
+                redis.call('HSET', queue_fleet.allocation_queue_vtime_key, 'now', finish)
+            end
+            redis.call('PUBLISH', queue_fleet.capacity_channel, queue_fleet.name)
+        else
+            redis.call('DEL', queue_fleet.allocation_queue_vtime_key)
+        end
     end
+    local result = {container_id = container_id, fleet_name = fleet.name, region = container_region(fleet, container_id), zone = container_zone(fleet, container_id), reserved_until_ms = reserved_until}
+    if preempted then
+        result.preempted_room_id = preempted.room_id
+        result.preempted_priority = preempted.priority
+    end
+    return cjson.encode(result)
 end
 
-if not container_id then
+-- Try the fleets (and regions) in order and allocate the room to the first container found
+for _, target in ipairs(search_order(fleets, req)) do
+    local fleet = target.fleet
+    req.region = target.region
+    local container_id = is_turn(fleet, req.ticket_id) and choose_container(fleet)
+    local reserved_until
+    while container_id do
+        local room_key = fleet.room_prefix .. req.room_id
+        if req.reservation_ttl_ms then
+            -- Hold the slot without notifying the container until the reservation is committed
+            reserved_until = now_ms() + req.reservation_ttl_ms
+            redis.call('HSET', room_key, 'state', 'reserved')
+            redis.call('ZADD', fleet.reservations_key, reserved_until, req.room_id)
+            break
+        end
+        -- The container with a live heartbeat may have lost its subscription (e.g. the backend instance died).
+        -- If nobody received the event, mark the container suspect and try the next candidate.
+        -- The event is published before the room is recorded, so there is nothing to undo.
+        if redis.call('PUBLISH', fleet.container_channel_prefix .. container_id, req.allocation_event) > 0 then
+            redis.call('HSET', room_key, 'state', 'allocated')
+            break
+        end
+        suspects[fleet.name .. ':' .. container_id] = true
+        penalize_container(fleet, container_id, now_ms() + req.penalty_ms)
+        container_id = choose_container(fleet)
+    end
+    if conflict then
+        return cjson.encode({conflict = true})
+    end
+    if container_id then
+        return commit_allocation(fleet, container_id, reserved_until)
+    end
+end
+
+-- No container can host the room: preempt a room of lower priority and take over its slot.
+-- The container is told to stop the preempted room within the grace period (see RoomPreemptedEvent).
+-- The preempted room keeps its slot until it is released or the grace period has passed (see reap_preempted_rooms);
+-- meanwhile the room is pending, and its AllocationEvent is sent when it takes over the slot (see release_room).
+-- A reservation does not preempt, because it may never be committed.
+if not req.reservation_ttl_ms and not req.use_selected then
+    for _, target in ipairs(search_order(fleets, req)) do
+        local fleet = target.fleet
+        req.region = target.region
+        local victim = is_turn(fleet, req.ticket_id) and find_preemption_victim(fleet, req, suspects)
+        if victim then
+            local grace_period_ms = req.preemption_grace_period_ms or 0
+            redis.call('HSET', fleet.room_prefix .. victim.room_id, 'preempted_by', req.room_id)
+            redis.call('ZREM', fleet.room_priorities_key, victim.room_id)
+            redis.call('ZADD', fleet.preempted_rooms_key, now_ms() + grace_period_ms, victim.room_id)
+            redis.call('PUBLISH', fleet.container_channel_prefix .. victim.container_id, 'RoomPreemptedEvent:' .. cjson.encode({room_id = victim.room_id, grace_period_ms = grace_period_ms}))
+            -- Keep the penalty for the container in case it does not receive the AllocationEvent on takeover
+            redis.call('HSET', fleet.room_prefix .. req.room_id, 'state', 'pending', 'penalty_ms', req.penalty_ms)
+            local result = commit_allocation(fleet, victim.container_id, nil, victim)
+            if grace_period_ms <= 0 then
+                release_room(fleet, victim.container_id, victim.room_id)
+            end
+            return result
+        end
+    end
+end
+for _, rejection in ipairs(rejections) do
+    if rejection.reason == 'anti_affinity' then
+        return cjson.encode({anti_affinity_violated = true})
+    end
+end
+return nil
+`)
+
+	commitReservationScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local room_id = ARGV[2]
+reap_expired_reservations(fleet)
+if not redis.call('ZSCORE', fleet.reservations_key, room_id) then
     return nil
 end
+local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+local room_key = fleet.room_prefix .. room_id
+local allocation_event = redis.call('HGET', room_key, 'allocation_event')
+redis.call('ZREM', fleet.reservations_key, room_id)
+-- If nobody received the event (e.g. the backend instance died), release the room and penalize the container
+if redis.call('PUBLISH', fleet.container_channel_prefix .. container_id, allocation_event) == 0 then
+    release_room(fleet, container_id, room_id)
+    penalize_container(fleet, container_id, now_ms() + tonumber(ARGV[3]))
+    return 0
+end
+redis.call('HSET', room_key, 'state', 'allocated')
+return 1
+`)
 
-local room_id = ARGV[1]
-local fleet_name = ARGV[2]
-redis.call('ZINCRBY', available_containers_key, -1, container_id)
-redis.call('SET', room_container_key, container_id)
+	cancelReservationScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local room_id = ARGV[2]
+reap_expired_reservations(fleet)
+if not redis.call('ZSCORE', fleet.reservations_key, room_id) then
+    return nil
+end
+release_room(fleet, redis.call('GET', fleet.room_container_prefix .. room_id), room_id)
+return 0
+`)
 
-local container_to_rooms_key = KEYS[3] .. container_id
-redis.call('SADD', container_to_rooms_key, room_id)
+	// reapPreemptedRoomsScript hands the slots of the preempted rooms whose grace period has passed over.
+	reapPreemptedRoomsScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+reap_preempted_rooms(fleet)
+return 0
+`)
 
-local container_channel = KEYS[4] .. container_id
-local allocation_event = ARGV[3]
-redis.call('PUBLISH', container_channel, allocation_event)
+	// deallocateRoomScript releases a room and notifies its container.
+	// A reserved or pending room is released without notification, because the container does not know it yet.
+	// It returns nil if the room does not exist.
+	deallocateRoomScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local room_id = ARGV[2]
+local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+if not container_id then
+    return nil
+end
+-- Notify before releasing, because a room that preempted the room is sent to the container on release
+if redis.call('HGET', fleet.room_prefix .. room_id, 'state') == 'allocated' then
+    redis.call('PUBLISH', fleet.container_channel_prefix .. container_id, ARGV[3])
+end
+release_room(fleet, container_id, room_id)
 return container_id
 `)
 )
@@ -75,12 +243,26 @@ type RedisFrontendOption interface {
 }
 
 type redisFrontendOptions struct {
-	candidateContainerMaxCount int
+	candidateContainerMaxCount   int
+	candidateContainerScanLimit  int
+	allocationStrategy           arena.AllocationStrategy
+	allocationQueuePollInterval  time.Duration
+	unresponsiveContainerPenalty time.Duration
+	topCandidateCount            int
+	topCandidateWeighting        CandidateWeighting
+	containerSelector            ContainerSelector
+	preemptionGracePeriod        time.Duration
+	globalRoomRegistry           bool
 }
 
 func newRedisFrontendOptions(opts ...RedisFrontendOption) *redisFrontendOptions {
 	options := &redisFrontendOptions{
-		candidateContainerMaxCount: defaultCandidateContainerMaxCount,
+		candidateContainerMaxCount:   defaultCandidateContainerMaxCount,
+		candidateContainerScanLimit:  defaultCandidateContainerScanLimit,
+		allocationStrategy:           arena.AllocationStrategyPacked,
+		allocationQueuePollInterval:  defaultAllocationQueuePollInterval,
+		unresponsiveContainerPenalty: defaultUnresponsiveContainerPenalty,
+		preemptionGracePeriod:        defaultPreemptionGracePeriod,
 	}
 	for _, opt := range opts {
 		opt.apply(options)
@@ -94,47 +276,189 @@ func (f redisFrontendOptionFunc) apply(options *redisFrontendOptions) {
 	f(options)
 }
 
+// WithCandidateContainerMaxCount sets how many containers with vacancy are read at a time to find a host.
+// Candidates are read page by page until a host is found (see WithCandidateContainerScanLimit).
 func WithCandidateContainerMaxCount(count int) RedisFrontendOption {
 	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
 		options.candidateContainerMaxCount = count
 	})
 }
 
+// WithCandidateContainerScanLimit sets how many containers with vacancy are scanned at most to find a host,
+// bounding the time an allocation blocks Redis when few containers match the request.
+// It also bounds how many rooms are scanned to find a room to preempt (see arena.AllocateRoomRequest.Priority).
+// If 0, every container with vacancy is scanned. The default is 1000.
+func WithCandidateContainerScanLimit(limit int) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.candidateContainerScanLimit = limit
+	})
+}
+
+// WithAllocationStrategy sets the default allocation strategy of the Frontend.
+// It can be overridden per request by AllocateRoomRequest.Strategy.
+// The default is arena.AllocationStrategyPacked.
+func WithAllocationStrategy(strategy arena.AllocationStrategy) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.allocationStrategy = strategy
+	})
+}
+
+// WithAllocationQueuePollInterval sets the interval at which a request waiting for capacity
+// retries the allocation even without being notified of freed capacity.
+func WithAllocationQueuePollInterval(interval time.Duration) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.allocationQueuePollInterval = interval
+	})
+}
+
+// WithUnresponsiveContainerPenalty sets how long an unresponsive container is excluded from allocation:
+// a container that did not acknowledge an allocation within AllocateRoomRequest.AckTimeout,
+// or a container that is not subscribed to its events despite its heartbeat.
+func WithUnresponsiveContainerPenalty(penalty time.Duration) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.unresponsiveContainerPenalty = penalty
+	})
+}
+
+// WithPreemptionGracePeriod sets how long the container of a preempted room is given to stop it
+// (see arena.RoomPreemptedEvent). The default is 30 seconds.
+func WithPreemptionGracePeriod(gracePeriod time.Duration) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.preemptionGracePeriod = gracePeriod
+	})
+}
+
+// WithGlobalRoomRegistry records every room in a registry shared by all the fleets.
+// A RoomID can then be allocated in only one fleet at a time,
+// and NotifyToRoom, GetRoom, DeallocateRoom, CommitReservation and CancelReservation work without FleetName.
+// All the Frontends sharing the key prefix should use the same setting.
+func WithGlobalRoomRegistry() RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.globalRoomRegistry = true
+	})
+}
+
+// CandidateWeighting decides how likely each of the top candidates is picked (see WithTopCandidates).
+type CandidateWeighting string
+
+const (
+	// CandidateWeightingUniform picks each of the top candidates with equal probability.
+	CandidateWeightingUniform CandidateWeighting = "uniform"
+	// CandidateWeightingFreeCapacity picks each of the top candidates with probability proportional to its free capacity.
+	CandidateWeightingFreeCapacity CandidateWeighting = "free_capacity"
+)
+
+// WithTopCandidates makes the Frontend pick the container at random among the first k live candidates
+// (in the order of the allocation strategy) that can host the room, instead of always the first one.
+// This avoids a burst of allocations all going to the same container at the same moment.
+func WithTopCandidates(k int, weighting CandidateWeighting) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.topCandidateCount = k
+		options.topCandidateWeighting = weighting
+	})
+}
+
 func NewFrontend(keyPrefix string, client rueidis.Client, opts ...RedisFrontendOption) arena.Frontend {
 	options := newRedisFrontendOptions(opts...)
 	return &redisFrontend{keyPrefix: keyPrefix, client: client, options: options}
 }
 
 func (a *redisFrontend) AllocateRoom(ctx context.Context, req arena.AllocateRoomRequest) (*arena.AllocateRoomResponse, error) {
-	if req.RoomID == "" {
-		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	if err := validateAllocateRoomRequest(req); err != nil {
+		return nil, err
 	}
-	if req.FleetName == "" {
-		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+
+	result, err := a.allocate(ctx, req, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &arena.AllocateRoomResponse{RoomID: req.RoomID, ContainerID: result.ContainerID, FleetName: result.FleetName, Region: result.Region, Zone: result.Zone,
+		PreemptedRoomID: result.PreemptedRoomID, PreferredContainerHonored: isPreferredContainer(req, result)}, nil
+}
+
+func (a *redisFrontend) ReserveRoom(ctx context.Context, req arena.ReserveRoomRequest) (*arena.ReserveRoomResponse, error) {
+	if err := validateAllocateRoomRequest(req.AllocateRoomRequest); err != nil {
+		return nil, err
+	}
+	if req.TTL < 0 {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid reservation TTL: %s", req.TTL))
+	}
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = arena.DefaultReservationTTL
 	}
 
-	containerID, err := a.allocateRoom(ctx, req)
+	result, err := a.allocate(ctx, req.AllocateRoomRequest, ttl)
 	if err != nil {
 		return nil, err
 	}
-	return &arena.AllocateRoomResponse{RoomID: req.RoomID, ContainerID: containerID}, nil
+	resp := &arena.ReserveRoomResponse{RoomID: req.RoomID, ContainerID: result.ContainerID, FleetName: result.FleetName, Region: result.Region, Zone: result.Zone,
+		PreferredContainerHonored: isPreferredContainer(req.AllocateRoomRequest, result)}
+	if result.ReservedUntilMs > 0 {
+		resp.ExpiresAt = time.UnixMilli(result.ReservedUntilMs)
+	}
+	return resp, nil
 }
 
-func (a *redisFrontend) NotifyToRoom(ctx context.Context, req arena.NotifyToRoomRequest) error {
+func (a *redisFrontend) CommitReservation(ctx context.Context, req arena.CommitReservationRequest) error {
 	if req.RoomID == "" {
 		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
 	}
-	if req.FleetName == "" {
-		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	fleetName, err := a.resolveRoomFleet(ctx, req.FleetName, req.RoomID)
+	if err != nil {
+		return err
+	}
+	keys := fleetScriptKeys(a.keyPrefix, fleetName)
+	penalty := strconv.FormatInt(a.options.unresponsiveContainerPenalty.Milliseconds(), 10)
+	res := commitReservationScript.Exec(ctx, a.client, keys, []string{fleetName, req.RoomID, penalty})
+	committed, err := res.AsInt64()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("reservation of room %s not found in fleet %s", req.RoomID, fleetName))
+		}
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to commit reservation: %w", err))
+	}
+	if committed == 0 {
+		return arena.NewError(arena.ErrorStatusResourceExhausted, fmt.Errorf("container of room %s is not subscribed to its events; the reservation has been released", req.RoomID))
+	}
+	return nil
+}
+
+func (a *redisFrontend) CancelReservation(ctx context.Context, req arena.CancelReservationRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	fleetName, err := a.resolveRoomFleet(ctx, req.FleetName, req.RoomID)
+	if err != nil {
+		return err
+	}
+	keys := fleetScriptKeys(a.keyPrefix, fleetName)
+	res := cancelReservationScript.Exec(ctx, a.client, keys, []string{fleetName, req.RoomID})
+	if err := res.Error(); err != nil {
+		if rueidis.IsRedisNil(err) {
+			return arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("reservation of room %s not found in fleet %s", req.RoomID, fleetName))
+		}
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to cancel reservation: %w", err))
+	}
+	return nil
+}
+
+func (a *redisFrontend) NotifyToRoom(ctx context.Context, req arena.NotifyToRoomRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
 	}
 	if len(req.Body) == 0 {
 		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing body"))
 	}
-	containerID, err := a.getContainerIDByRoom(ctx, req.FleetName, req.RoomID)
+	fleetName, err := a.resolveRoomFleet(ctx, req.FleetName, req.RoomID)
+	if err != nil {
+		return err
+	}
+	containerID, err := a.getContainerIDByRoom(ctx, fleetName, req.RoomID)
 	if err != nil {
-		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to parse redis result as string: %w", err))
+		return err
 	}
-	channel := redisPubSubChannelContainer(a.keyPrefix, req.FleetName, containerID)
+	channel := redisPubSubChannelContainer(a.keyPrefix, fleetName, containerID)
 	data, err := encodeNotifyToRoomEvent(req.RoomID, req.Body)
 	if err != nil {
 		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode NotifyToRoomEvent: %w", err))
@@ -146,29 +470,191 @@ func (a *redisFrontend) NotifyToRoom(ctx context.Context, req arena.NotifyToRoom
 	return nil
 }
 
-func (a *redisFrontend) allocateRoom(ctx context.Context, req arena.AllocateRoomRequest) (string, error) {
-	allocationEvent, err := encodeAllocationEvent(req.RoomID, req.RoomInitialData)
+func (a *redisFrontend) DeallocateRoom(ctx context.Context, req arena.DeallocateRoomRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	fleetName, err := a.resolveRoomFleet(ctx, req.FleetName, req.RoomID)
+	if err != nil {
+		return err
+	}
+	event, err := encodeRoomDeallocatedEvent(req.RoomID)
 	if err != nil {
-		return "", arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation event: %w", err))
+		return arena.NewError(arena.ErrorStatusUnknown, err)
 	}
-	res := allocateRoomScript.Exec(ctx, a.client, []string{
-		redisKeyRoomToContainer(a.keyPrefix, req.FleetName, req.RoomID),
-		redisKeyAvailableContainersIndex(a.keyPrefix, req.FleetName),
-		redisKeyContainerToRoomsPrefix(a.keyPrefix, req.FleetName),
-		redisPubSubChannelContainerPrefix(a.keyPrefix, req.FleetName),
-		redisKeyContainerHeartbeatPrefix(a.keyPrefix, req.FleetName),
-	}, []string{req.RoomID, req.FleetName, allocationEvent, strconv.Itoa(a.options.candidateContainerMaxCount)})
+	keys := fleetScriptKeys(a.keyPrefix, fleetName)
+	res := deallocateRoomScript.Exec(ctx, a.client, keys, []string{fleetName, req.RoomID, event})
 	if err := res.Error(); err != nil {
 		if rueidis.IsRedisNil(err) {
-			return "", arena.NewError(arena.ErrorStatusResourceExhausted, errors.New("no available container"))
+			return arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("room %s not found in fleet %s", req.RoomID, fleetName))
 		}
-		return "", arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to allocate room: %w", err))
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to deallocate room: %w", err))
 	}
-	containerID, err := res.ToString()
+	return nil
+}
+
+// allocate allocates a room, waiting for capacity if requested.
+// If reservationTTL is positive, the room is reserved instead (see ReserveRoom).
+func (a *redisFrontend) allocate(ctx context.Context, req arena.AllocateRoomRequest, reservationTTL time.Duration) (*allocateRoomScriptResult, error) {
+	if req.AckTimeout == 0 || reservationTTL > 0 {
+		return a.allocateOnce(ctx, req, reservationTTL)
+	}
+	// place the room on another container until one acknowledges it
+	for range defaultAllocationAckMaxAttempts {
+		result, err := a.allocateOnce(ctx, req, 0)
+		if err != nil {
+			return nil, err
+		}
+		// A room that preempted another is sent to the container only after the grace period at most
+		if result.PreemptedRoomID != "" {
+			return result, nil
+		}
+		acked, err := a.waitForAck(ctx, req.RoomID, result, req.AckTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if acked {
+			return result, nil
+		}
+	}
+	return nil, arena.NewError(arena.ErrorStatusResourceExhausted, fmt.Errorf("no container acknowledged room %s after %d attempts", req.RoomID, defaultAllocationAckMaxAttempts))
+}
+
+func (a *redisFrontend) allocateOnce(ctx context.Context, req arena.AllocateRoomRequest, reservationTTL time.Duration) (*allocateRoomScriptResult, error) {
+	if req.WaitForCapacity {
+		return a.allocateRoomWaitingForCapacity(ctx, req, reservationTTL)
+	}
+	return a.allocateRoom(ctx, req, reservationTTL, "")
+}
+
+// allocateRoom tries to allocate a room once.
+// ticketID is the ticket in the allocation queue of the request, or empty if the request is not queued.
+func (a *redisFrontend) allocateRoom(ctx context.Context, req arena.AllocateRoomRequest, reservationTTL time.Duration, ticketID string) (*allocateRoomScriptResult, error) {
+	scriptReq, err := a.newAllocateRoomScriptRequest(req)
 	if err != nil {
-		return "", arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to parse redis result as string: %w", err))
+		return nil, err
 	}
-	return containerID, nil
+	scriptReq.TicketID = ticketID
+	if reservationTTL > 0 {
+		scriptReq.ReservationTTLMs = reservationTTL.Milliseconds()
+	}
+	if a.options.containerSelector != nil {
+		return a.allocateRoomWithSelector(ctx, req, scriptReq)
+	}
+	return a.execAllocateRoomScript(ctx, req, scriptReq)
+}
+
+func (a *redisFrontend) execAllocateRoomScript(ctx context.Context, req arena.AllocateRoomRequest, scriptReq allocateRoomScriptRequest) (*allocateRoomScriptResult, error) {
+	encodedReq, err := encodeAllocateRoomScriptRequest(scriptReq)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation request: %w", err))
+	}
+	res := allocateRoomScript.Exec(ctx, a.client, multiFleetScriptKeys(a.keyPrefix, scriptReq.FleetNames), []string{encodedReq})
+	if err := res.Error(); err != nil {
+		if rueidis.IsRedisNil(err) {
+			return nil, arena.NewError(arena.ErrorStatusResourceExhausted, errors.New("no available container"))
+		}
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to allocate room: %w", err))
+	}
+	data, err := res.ToString()
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to parse redis result as string: %w", err))
+	}
+	result, err := decodeAllocateRoomScriptResult(data)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+	if result.AntiAffinityViolated {
+		return nil, arena.NewError(arena.ErrorStatusUnsatisfiable, fmt.Errorf("every available container already hosts a room of anti-affinity group '%s'", req.AntiAffinityGroup))
+	}
+	if result.Reserved {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("room %s is reserved in fleet %s; commit or cancel the reservation", req.RoomID, result.FleetName))
+	}
+	if result.RegisteredFleet != "" {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("room %s has already been allocated in fleet %s", req.RoomID, result.RegisteredFleet))
+	}
+	if result.PreemptedRoomID != "" {
+		slog.InfoContext(ctx, fmt.Sprintf("room '%s' (priority %d) preempted room '%s' (priority %d)", req.RoomID, req.Priority, result.PreemptedRoomID, result.PreemptedPriority),
+			"fleet", result.FleetName, "container", result.ContainerID, "room", req.RoomID, "preempted_room", result.PreemptedRoomID)
+		// Hand the slot over when the grace period has passed, unless the preempted room is released earlier.
+		// If this Frontend goes away, the next allocation in the fleet does it.
+		time.AfterFunc(a.options.preemptionGracePeriod, func() {
+			a.reapPreemptedRooms(context.WithoutCancel(ctx), result.FleetName)
+		})
+	}
+	return result, nil
+}
+
+func (a *redisFrontend) reapPreemptedRooms(ctx context.Context, fleetName string) {
+	keys := fleetScriptKeys(a.keyPrefix, fleetName)
+	if err := reapPreemptedRoomsScript.Exec(ctx, a.client, keys, []string{fleetName}).Error(); err != nil {
+		slog.WarnContext(ctx, fmt.Sprintf("failed to reap preempted rooms in fleet '%s': %+v", fleetName, err), "error", err)
+	}
+}
+
+func (a *redisFrontend) newAllocateRoomScriptRequest(req arena.AllocateRoomRequest) (allocateRoomScriptRequest, error) {
+	allocationEvent, err := encodeAllocationEvent(req.RoomID, req.RoomInitialData)
+	if err != nil {
+		return allocateRoomScriptRequest{}, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation event: %w", err))
+	}
+	strategy := req.Strategy
+	if strategy == "" {
+		strategy = a.options.allocationStrategy
+	}
+	regions, err := rankRegionsByLatency(req.PlayerLatencies, req.LatencyObjective)
+	if err != nil {
+		return allocateRoomScriptRequest{}, err
+	}
+	return allocateRoomScriptRequest{
+		RoomID:                  req.RoomID,
+		FleetNames:              append([]string{req.FleetName}, req.FallbackFleetNames...),
+		AllocationEvent:         allocationEvent,
+		CandidateCount:          a.options.candidateContainerMaxCount,
+		ScanLimit:               a.options.candidateContainerScanLimit,
+		LabelSelector:           newLabelSelectorJSON(req.LabelSelector),
+		Resources:               req.Resources,
+		Strategy:                string(strategy),
+		Seed:                    rand.Int64N(math.MaxInt32),
+		AffinityKey:             req.AffinityKey,
+		AntiAffinityGroup:       req.AntiAffinityGroup,
+		AntiAffinityTopologyKey: req.AntiAffinityTopologyKey,
+		AntiAffinityTopology:    topologyKeyFields[req.AntiAffinityTopologyKey],
+		PreferredZones:          req.PreferredZones,
+		PreferredRegions:        regions,
+		Exclusive:               req.Exclusive,
+		Priority:                req.Priority,
+		PreferredContainerID:    req.PreferredContainerID,
+		Properties:              req.Properties,
+		GlobalRoomRegistry:      a.options.globalRoomRegistry,
+		PreemptionGracePeriodMs: a.options.preemptionGracePeriod.Milliseconds(),
+		TopK:                    a.options.topCandidateCount,
+		TopKWeighting:           string(a.options.topCandidateWeighting),
+		PenaltyMs:               a.options.unresponsiveContainerPenalty.Milliseconds(),
+	}, nil
+}
+
+// isPreferredContainer reports whether the room was allocated to AllocateRoomRequest.PreferredContainerID.
+func isPreferredContainer(req arena.AllocateRoomRequest, result *allocateRoomScriptResult) bool {
+	return req.PreferredContainerID != "" && result.ContainerID == req.PreferredContainerID
+}
+
+// resolveRoomFleet returns fleetName, or the fleet of the room in the global room registry if fleetName is empty.
+func (a *redisFrontend) resolveRoomFleet(ctx context.Context, fleetName, roomID string) (string, error) {
+	if fleetName != "" {
+		return fleetName, nil
+	}
+	if !a.options.globalRoomRegistry {
+		return "", arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	}
+	cmd := a.client.B().Hget().Key(redisKeyRoomRegistry(a.keyPrefix)).Field(roomID).Build()
+	fleetName, err := a.client.Do(ctx, cmd).ToString()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return "", arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("room %s not found", roomID))
+		}
+		return "", arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to find fleet by room: %w", err))
+	}
+	return fleetName, nil
 }
 
 func (a *redisFrontend) getContainerIDByRoom(ctx context.Context, fleetName, roomID string) (string, error) {
@@ -187,3 +673,82 @@ func (a *redisFrontend) getContainerIDByRoom(ctx context.Context, fleetName, roo
 	}
 	return containerID, nil
 }
+
+func validateLabelSelector(selector arena.LabelSelector) error {
+	for _, req := range selector.MatchExpressions {
+		if req.Key == "" {
+			return errors.New("missing label selector key")
+		}
+		switch req.Operator {
+		case arena.LabelSelectorOpIn, arena.LabelSelectorOpNotIn:
+			if len(req.Values) == 0 {
+				return fmt.Errorf("label selector operator '%s' requires values", req.Operator)
+			}
+		case arena.LabelSelectorOpExists, arena.LabelSelectorOpDoesNotExist:
+			if len(req.Values) > 0 {
+				return fmt.Errorf("label selector operator '%s' does not accept values", req.Operator)
+			}
+		default:
+			return fmt.Errorf("unknown label selector operator '%s'", req.Operator)
+		}
+	}
+	return nil
+}
+
+func validateFallbackFleetNames(fleetName string, fallbackFleetNames []string) error {
+	seen := map[string]struct{}{fleetName: {}}
+	for _, name := range fallbackFleetNames {
+		if name == "" {
+			return errors.New("missing fallback fleet name")
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("duplicated fleet name '%s'", name)
+		}
+		seen[name] = struct{}{}
+	}
+	return nil
+}
+
+func validateAllocateRoomRequest(req arena.AllocateRoomRequest) error {
+	if req.RoomID == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	if req.FleetName == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	}
+	if err := validateLabelSelector(req.LabelSelector); err != nil {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, err)
+	}
+	for name, amount := range req.Resources {
+		if name == "" || amount < 0 {
+			return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid resource request '%s': %d", name, amount))
+		}
+	}
+	switch req.Strategy {
+	case "", arena.AllocationStrategyPacked, arena.AllocationStrategyDistributed, arena.AllocationStrategyRandom:
+	default:
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("unknown allocation strategy '%s'", req.Strategy))
+	}
+	if err := validateFallbackFleetNames(req.FleetName, req.FallbackFleetNames); err != nil {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, err)
+	}
+	if req.TenantWeight < 0 {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid tenant weight: %d", req.TenantWeight))
+	}
+	if req.AntiAffinityTopologyKey != "" && req.AntiAffinityGroup == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("anti-affinity topology key requires anti-affinity group"))
+	}
+	switch req.LatencyObjective {
+	case "", arena.LatencyObjectiveMax, arena.LatencyObjectiveAverage:
+	default:
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("unknown latency objective '%s'", req.LatencyObjective))
+	}
+	// BLPOP regards a timeout of 0 as infinite, so a positive timeout must be at least 1ms
+	if req.AckTimeout < 0 || (req.AckTimeout > 0 && req.AckTimeout < time.Millisecond) {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid ack timeout: %s", req.AckTimeout))
+	}
+	if err := validateRoomProperties(req.Properties); err != nil {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, err)
+	}
+	return nil
+}
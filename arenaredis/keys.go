@@ -8,8 +8,12 @@ func redisKeyAvailableContainersIndex(prefix, fleetName string) string {
 	return fmt.Sprintf("%s%s:container_index", prefix, fleetName)
 }
 
+func redisKeyRoomToContainerPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_container:", prefix, fleetName)
+}
+
 func redisKeyRoomToContainer(prefix, fleetName, roomID string) string {
-	return fmt.Sprintf("%s%s:room_container:%s", prefix, fleetName, roomID)
+	return fmt.Sprintf("%s%s", redisKeyRoomToContainerPrefix(prefix, fleetName), roomID)
 }
 
 func redisKeyContainerToRoomsPrefix(prefix, fleetName string) string {
@@ -35,3 +39,124 @@ func redisKeyContainerHeartbeatPrefix(prefix, fleetName string) string {
 func redisKeyContainerHeartbeat(prefix, fleetName, containerID string) string {
 	return fmt.Sprintf("%s%s", redisKeyContainerHeartbeatPrefix(prefix, fleetName), containerID)
 }
+
+func redisKeyContainerLabelsPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:container_labels:", prefix, fleetName)
+}
+
+func redisKeyContainerLabels(prefix, fleetName, containerID string) string {
+	return fmt.Sprintf("%s%s", redisKeyContainerLabelsPrefix(prefix, fleetName), containerID)
+}
+
+func redisKeyContainerResourcesPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:container_resources:", prefix, fleetName)
+}
+
+func redisKeyContainerResources(prefix, fleetName, containerID string) string {
+	return fmt.Sprintf("%s%s", redisKeyContainerResourcesPrefix(prefix, fleetName), containerID)
+}
+
+func redisKeyRoomPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room:", prefix, fleetName)
+}
+
+func redisKeyRoom(prefix, fleetName, roomID string) string {
+	return fmt.Sprintf("%s%s", redisKeyRoomPrefix(prefix, fleetName), roomID)
+}
+
+func redisKeyAllocationQueue(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:allocation_queue", prefix, fleetName)
+}
+
+func redisKeyAllocationQueueVirtualTime(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:allocation_queue_vtime", prefix, fleetName)
+}
+
+func redisKeyAllocationTicketPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:allocation_ticket:", prefix, fleetName)
+}
+
+func redisKeyAllocationTicket(prefix, fleetName, ticketID string) string {
+	return fmt.Sprintf("%s%s", redisKeyAllocationTicketPrefix(prefix, fleetName), ticketID)
+}
+
+func redisPubSubChannelCapacity(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:capacity_channel", prefix, fleetName)
+}
+
+func redisKeyReservations(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:reservations", prefix, fleetName)
+}
+
+func redisKeyContainerPenalty(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:container_penalty", prefix, fleetName)
+}
+
+func redisKeyRoomAckPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_ack:", prefix, fleetName)
+}
+
+func redisKeyRoomAck(prefix, fleetName, roomID string) string {
+	return fmt.Sprintf("%s%s", redisKeyRoomAckPrefix(prefix, fleetName), roomID)
+}
+
+func redisKeyAffinityPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:affinity:", prefix, fleetName)
+}
+
+func redisKeyAffinity(prefix, fleetName, affinityKey string) string {
+	return fmt.Sprintf("%s%s", redisKeyAffinityPrefix(prefix, fleetName), affinityKey)
+}
+
+func redisKeyAntiAffinityPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:anti_affinity:", prefix, fleetName)
+}
+
+func redisKeyContainerTopologyPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:container_topology:", prefix, fleetName)
+}
+
+func redisKeyContainerTopology(prefix, fleetName, containerID string) string {
+	return fmt.Sprintf("%s%s", redisKeyContainerTopologyPrefix(prefix, fleetName), containerID)
+}
+
+func redisKeyRoomPriorities(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_priorities", prefix, fleetName)
+}
+
+func redisKeyRoomRegistry(prefix string) string {
+	return fmt.Sprintf("%sroom_registry", prefix)
+}
+
+func redisKeyRoomAllocationTimes(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_allocated_at", prefix, fleetName)
+}
+
+// redisKeySearchableRooms is the sorted set of the rooms with properties, all scored 0 to be read in order of room ID.
+func redisKeySearchableRooms(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:searchable_rooms", prefix, fleetName)
+}
+
+func redisKeyRoomPropertyValuesPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_property_values:", prefix, fleetName)
+}
+
+// redisKeyRoomPropertyValue is the set of the rooms with a property value.
+// The name is prefixed by its length, so that a name and a value cannot be confused. See room_property_value_key in Lua.
+func redisKeyRoomPropertyValue(prefix, fleetName, name, value string) string {
+	return fmt.Sprintf("%s%d:%s=%s", redisKeyRoomPropertyValuesPrefix(prefix, fleetName), len(name), name, value)
+}
+
+func redisKeyRoomPropertyNumbersPrefix(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:room_property_numbers:", prefix, fleetName)
+}
+
+// redisKeyRoomPropertyNumbers is the sorted set of the rooms scored by the value of a numeric property.
+// See room_property_number_key in Lua.
+func redisKeyRoomPropertyNumbers(prefix, fleetName, name string) string {
+	return fmt.Sprintf("%s%s", redisKeyRoomPropertyNumbersPrefix(prefix, fleetName), name)
+}
+
+func redisKeyPreemptedRooms(prefix, fleetName string) string {
+	return fmt.Sprintf("%s%s:preempted_rooms", prefix, fleetName)
+}
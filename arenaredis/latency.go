@@ -0,0 +1,51 @@
+package arenaredis
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/castaneai/arena"
+)
+
+// rankRegionsByLatency returns the regions measured by every player, in ascending order of the objective.
+func rankRegionsByLatency(playerLatencies []map[string]time.Duration, objective arena.LatencyObjective) ([]string, error) {
+	if len(playerLatencies) == 0 {
+		return nil, nil
+	}
+	scores := map[string]time.Duration{}
+	for region := range playerLatencies[0] {
+		var total, worst time.Duration
+		measured := true
+		for _, latencies := range playerLatencies {
+			latency, ok := latencies[region]
+			if !ok {
+				measured = false
+				break
+			}
+			total += latency
+			worst = max(worst, latency)
+		}
+		if !measured {
+			continue
+		}
+		if objective == arena.LatencyObjectiveAverage {
+			scores[region] = total / time.Duration(len(playerLatencies))
+		} else {
+			scores[region] = worst
+		}
+	}
+	if len(scores) == 0 {
+		return nil, arena.NewError(arena.ErrorStatusUnsatisfiable, errors.New("no region is measured by every player"))
+	}
+
+	regions := make([]string, 0, len(scores))
+	for region := range scores {
+		regions = append(regions, region)
+	}
+	slices.SortFunc(regions, func(a, b string) int {
+		return cmp.Or(cmp.Compare(scores[a], scores[b]), cmp.Compare(a, b))
+	})
+	return regions, nil
+}
@@ -0,0 +1,798 @@
+package arenaredis
+
+import (
+	"github.com/redis/rueidis"
+)
+
+// fleetScriptKeys returns the keys of a fleet passed to the Lua scripts built by newLuaScript.
+// The order must match load_fleets in luaLibrary.
+func fleetScriptKeys(keyPrefix, fleetName string) []string {
+	return []string{
+		redisKeyRoomToContainerPrefix(keyPrefix, fleetName),
+		redisKeyAvailableContainersIndex(keyPrefix, fleetName),
+		redisKeyContainerToRoomsPrefix(keyPrefix, fleetName),
+		redisPubSubChannelContainerPrefix(keyPrefix, fleetName),
+		redisKeyContainerHeartbeatPrefix(keyPrefix, fleetName),
+		redisKeyContainerLabelsPrefix(keyPrefix, fleetName),
+		redisKeyContainerResourcesPrefix(keyPrefix, fleetName),
+		redisKeyRoomPrefix(keyPrefix, fleetName),
+		redisKeyAllocationQueue(keyPrefix, fleetName),
+		redisKeyAllocationTicketPrefix(keyPrefix, fleetName),
+		redisPubSubChannelCapacity(keyPrefix, fleetName),
+		redisKeyAllocationQueueVirtualTime(keyPrefix, fleetName),
+		redisKeyReservations(keyPrefix, fleetName),
+		redisKeyContainerPenalty(keyPrefix, fleetName),
+		redisKeyRoomAckPrefix(keyPrefix, fleetName),
+		redisKeyAffinityPrefix(keyPrefix, fleetName),
+		redisKeyAntiAffinityPrefix(keyPrefix, fleetName),
+		redisKeyContainerTopologyPrefix(keyPrefix, fleetName),
+		redisKeyRoomPriorities(keyPrefix, fleetName),
+		redisKeyRoomRegistry(keyPrefix),
+		redisKeyRoomAllocationTimes(keyPrefix, fleetName),
+		redisKeySearchableRooms(keyPrefix, fleetName),
+		redisKeyPreemptedRooms(keyPrefix, fleetName),
+		redisKeyRoomPropertyValuesPrefix(keyPrefix, fleetName),
+		redisKeyRoomPropertyNumbersPrefix(keyPrefix, fleetName),
+	}
+}
+
+// multiFleetScriptKeys returns the keys of the fleets in order, passed to the Lua scripts built by newLuaScript.
+func multiFleetScriptKeys(keyPrefix string, fleetNames []string) []string {
+	var keys []string
+	for _, fleetName := range fleetNames {
+		keys = append(keys, fleetScriptKeys(keyPrefix, fleetName)...)
+	}
+	return keys
+}
+
+// luaLibrary is the common Lua code shared by the scripts that manipulate containers and rooms.
+const luaLibrary = `
+-- load_fleets returns the keys of the fleets. KEYS are grouped by fleet in the order of fleet_names (see fleetScriptKeys).
+local function load_fleets(fleet_names)
+    local keys_per_fleet = #KEYS / #fleet_names
+    local fleets = {}
+    for i, fleet_name in ipairs(fleet_names) do
+        local base = (i - 1) * keys_per_fleet
+        fleets[i] = {
+            name = fleet_name,
+            room_container_prefix = KEYS[base + 1],
+            available_containers_key = KEYS[base + 2],
+            container_to_rooms_prefix = KEYS[base + 3],
+            container_channel_prefix = KEYS[base + 4],
+            heartbeat_prefix = KEYS[base + 5],
+            container_labels_prefix = KEYS[base + 6],
+            container_resources_prefix = KEYS[base + 7],
+            room_prefix = KEYS[base + 8],
+            allocation_queue_key = KEYS[base + 9],
+            allocation_ticket_prefix = KEYS[base + 10],
+            capacity_channel = KEYS[base + 11],
+            allocation_queue_vtime_key = KEYS[base + 12],
+            reservations_key = KEYS[base + 13],
+            container_penalty_key = KEYS[base + 14],
+            room_ack_prefix = KEYS[base + 15],
+            affinity_prefix = KEYS[base + 16],
+            anti_affinity_prefix = KEYS[base + 17],
+            container_topology_prefix = KEYS[base + 18],
+            room_priorities_key = KEYS[base + 19],
+            room_registry_key = KEYS[base + 20],
+            room_allocation_times_key = KEYS[base + 21],
+            searchable_rooms_key = KEYS[base + 22],
+            preempted_rooms_key = KEYS[base + 23],
+            room_property_values_prefix = KEYS[base + 24],
+            room_property_numbers_prefix = KEYS[base + 25],
+        }
+    end
+    return fleets
+end
+
+local function now_ms()
+    local t = redis.call('TIME')
+    return tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+
+-- penalize_container excludes a container from allocation until the given time.
+local function penalize_container(fleet, container_id, until_ms)
+    redis.call('ZADD', fleet.container_penalty_key, until_ms, container_id)
+end
+
+-- count_group_room adds delta to the number of rooms of a group (e.g. an affinity key) on the container.
+-- The container is removed from the group when it has no room of the group.
+local function count_group_room(group_key, container_id, delta)
+    if redis.call('HINCRBY', group_key, container_id, delta) <= 0 then
+        redis.call('HDEL', group_key, container_id)
+    end
+end
+
+-- room_property_value_key returns the key of the set of the rooms with a property value (see redisKeyRoomPropertyValue).
+local function room_property_value_key(fleet, name, value)
+    return fleet.room_property_values_prefix .. #name .. ':' .. name .. '=' .. value
+end
+
+-- room_property_number_key returns the sorted set of the rooms scored by a numeric property (see redisKeyRoomPropertyNumbers).
+local function room_property_number_key(fleet, name)
+    return fleet.room_property_numbers_prefix .. name
+end
+
+-- is_property_number reports whether a property value is a decimal number (see parseRoomPropertyNumber).
+local function is_property_number(value)
+    local mantissa = string.match(value, '^[+-]?([%d.]+)$') or string.match(value, '^[+-]?([%d.]+)[eE][+-]?%d+$')
+    if not mantissa or not string.find(mantissa, '%d') or string.find(mantissa, '%..*%.') then
+        return false
+    end
+    local number = tonumber(value)
+    return number ~= nil and number ~= math.huge and number ~= -math.huge
+end
+
+-- release_room returns the capacity and the resources consumed by a room to its container, and deletes the room.
+-- The capacity is returned only if the room is still allocated to the container,
+-- so that releasing the same room twice does not increase the capacity.
+-- If the room has been preempted, the pending room that preempted it takes over the slot and is sent to the container;
+-- if nobody receives it (e.g. the backend instance died), the pending room is also released and the container is penalized.
+-- Nothing is done if the room is not allocated to the container, e.g. it has been placed on another container
+-- after the container failed to acknowledge it (see rollbackUnacknowledgedAllocationScript).
+local function release_room(fleet, container_id, room_id)
+    if redis.call('GET', fleet.room_container_prefix .. room_id) ~= container_id then
+        return
+    end
+    local room_key = fleet.room_prefix .. room_id
+    local preempted_by = redis.call('HGET', room_key, 'preempted_by')
+    if redis.call('SREM', fleet.container_to_rooms_prefix .. container_id, room_id) == 1 then
+        local slots = 1
+        local fields = redis.call('HGETALL', room_key)
+        for i = 1, #fields, 2 do
+            local name = string.match(fields[i], '^resource:(.+)$')
+            if fields[i] == 'slots' then
+                -- An exclusive room consumes the whole capacity of the container
+                slots = tonumber(fields[i + 1])
+            elseif name then
+                redis.call('HINCRBY', fleet.container_resources_prefix .. container_id, name, fields[i + 1])
+            elseif fields[i] == 'affinity_key' then
+                -- Forget the container of the affinity key when its last room is released
+                count_group_room(fleet.affinity_prefix .. fields[i + 1], container_id, -1)
+            elseif fields[i] == 'anti_affinity_group' then
+                count_group_room(fleet.anti_affinity_prefix .. fields[i + 1], container_id, -1)
+            end
+        end
+        redis.call('ZINCRBY', fleet.available_containers_key, slots, container_id)
+        -- Wake up the requests waiting for capacity
+        redis.call('PUBLISH', fleet.capacity_channel, container_id)
+    end
+    redis.call('ZREM', fleet.reservations_key, room_id)
+    redis.call('ZREM', fleet.room_priorities_key, room_id)
+    redis.call('ZREM', fleet.room_allocation_times_key, room_id)
+    redis.call('ZREM', fleet.searchable_rooms_key, room_id)
+    local fields = redis.call('HGETALL', room_key)
+    for i = 1, #fields, 2 do
+        local name = string.match(fields[i], '^property:(.+)$')
+        if name then
+            redis.call('SREM', room_property_value_key(fleet, name, fields[i + 1]), room_id)
+            redis.call('ZREM', room_property_number_key(fleet, name), room_id)
+        end
+    end
+    redis.call('ZREM', fleet.preempted_rooms_key, room_id)
+    if redis.call('HGET', fleet.room_registry_key, room_id) == fleet.name then
+        redis.call('HDEL', fleet.room_registry_key, room_id)
+    end
+    redis.call('DEL', fleet.room_container_prefix .. room_id, room_key, fleet.room_ack_prefix .. room_id)
+
+    if preempted_by and redis.call('GET', fleet.room_container_prefix .. preempted_by) == container_id then
+        local pending_key = fleet.room_prefix .. preempted_by
+        if redis.call('HGET', pending_key, 'state') == 'pending' then
+            local slots = tonumber(redis.call('HGET', pending_key, 'slots'))
+            if slots then
+                -- An exclusive room also takes the capacity returned by the preempted room
+                local returned = tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id)) or 0
+                redis.call('ZADD', fleet.available_containers_key, 0, container_id)
+                redis.call('HSET', pending_key, 'slots', slots + returned)
+            end
+            if redis.call('PUBLISH', fleet.container_channel_prefix .. container_id, redis.call('HGET', pending_key, 'allocation_event')) > 0 then
+                redis.call('HSET', pending_key, 'state', 'allocated')
+            else
+                local penalty_ms = tonumber(redis.call('HGET', pending_key, 'penalty_ms')) or 0
+                release_room(fleet, container_id, preempted_by)
+                penalize_container(fleet, container_id, now_ms() + penalty_ms)
+            end
+        end
+    end
+end
+
+-- registered_fleet returns the fleet of a room in the global room registry (see WithGlobalRoomRegistry), or nil.
+-- The registry is shared by all the fleets, so any fleet can be used to look it up.
+local function registered_fleet(fleet, room_id)
+    return redis.call('HGET', fleet.room_registry_key, room_id) or nil
+end
+
+-- set_room_properties merges the searchable properties into a room (see SearchRooms); an empty value removes the property.
+-- Only the rooms with properties are indexed for search, by each property value for the '=' filters
+-- and by each numeric property for sorting and the range filters.
+local function set_room_properties(fleet, room_id, properties)
+    local room_key = fleet.room_prefix .. room_id
+    for name, value in pairs(properties) do
+        local old = redis.call('HGET', room_key, 'property:' .. name)
+        if old then
+            redis.call('SREM', room_property_value_key(fleet, name, old), room_id)
+            redis.call('ZREM', room_property_number_key(fleet, name), room_id)
+        end
+        if value == '' then
+            redis.call('HDEL', room_key, 'property:' .. name)
+        else
+            redis.call('HSET', room_key, 'property:' .. name, value)
+            redis.call('SADD', room_property_value_key(fleet, name, value), room_id)
+            if is_property_number(value) then
+                -- The value is passed as is, so that it is not rounded by Lua
+                redis.call('ZADD', room_property_number_key(fleet, name), value, room_id)
+            end
+        end
+    end
+    for _, field in ipairs(redis.call('HKEYS', room_key)) do
+        if string.sub(field, 1, 9) == 'property:' then
+            redis.call('ZADD', fleet.searchable_rooms_key, 0, room_id)
+            return
+        end
+    end
+    redis.call('ZREM', fleet.searchable_rooms_key, room_id)
+end
+
+-- container_zone returns the zone of a container, or nil if it has no zone.
+local function container_zone(fleet, container_id)
+    return redis.call('HGET', fleet.container_topology_prefix .. container_id, 'zone') or nil
+end
+
+-- container_region returns the region of a container. A container without a region is regarded to be
+-- in the region named after its fleet, so that per-region fleets work without topology.
+local function container_region(fleet, container_id)
+    return redis.call('HGET', fleet.container_topology_prefix .. container_id, 'region') or fleet.name
+end
+
+-- search_order returns the fleets to search in order, each with the region to search in (nil for any region).
+-- If spec has preferred regions, all the fleets are searched for each region in order of preference.
+local function search_order(fleets, spec)
+    local order = {}
+    if spec.preferred_regions and #spec.preferred_regions > 0 then
+        for _, region in ipairs(spec.preferred_regions) do
+            for _, fleet in ipairs(fleets) do
+                table.insert(order, {fleet = fleet, region = region})
+            end
+        end
+    else
+        for _, fleet in ipairs(fleets) do
+            table.insert(order, {fleet = fleet})
+        end
+    end
+    return order
+end
+
+-- is_penalized reports whether a container is excluded from allocation.
+local function is_penalized(fleet, container_id)
+    local until_ms = redis.call('ZSCORE', fleet.container_penalty_key, container_id)
+    return until_ms and tonumber(until_ms) > now_ms()
+end
+
+-- released_of returns what the rooms due for reaping would return to a container in a dry run
+-- (see released_by_reaping), or nil.
+local function released_of(fleet, container_id, spec)
+    return spec.released and spec.released[fleet.name .. ':' .. container_id]
+end
+
+-- has_resources reports whether a container has enough of every resource left,
+-- counting the resources that would be returned to it (see released_of) if released is given.
+local function has_resources(fleet, container_id, resources, released)
+    for name, amount in pairs(resources) do
+        local remaining = tonumber(redis.call('HGET', fleet.container_resources_prefix .. container_id, name))
+        if remaining and released then
+            remaining = remaining + (released.resources[name] or 0)
+        end
+        if not remaining or remaining < amount then
+            return false
+        end
+    end
+    return true
+end
+
+-- match_labels reports whether the labels of a container match the label selector (see labelSelectorJSON).
+local function match_labels(fleet, container_id, selector)
+    if not selector.match_labels and not selector.match_expressions then
+        return true
+    end
+    local labels = {}
+    local fields = redis.call('HGETALL', fleet.container_labels_prefix .. container_id)
+    for i = 1, #fields, 2 do
+        labels[fields[i]] = fields[i + 1]
+    end
+    for key, value in pairs(selector.match_labels or {}) do
+        if labels[key] ~= value then
+            return false
+        end
+    end
+    for _, expr in ipairs(selector.match_expressions or {}) do
+        local value = labels[expr.key]
+        if expr.operator == 'Exists' then
+            if value == nil then
+                return false
+            end
+        elseif expr.operator == 'DoesNotExist' then
+            if value ~= nil then
+                return false
+            end
+        else
+            local contains = false
+            for _, v in ipairs(expr.values or {}) do
+                if v == value then
+                    contains = true
+                    break
+                end
+            end
+            if (expr.operator == 'In') ~= contains then
+                return false
+            end
+        end
+    end
+    return true
+end
+
+-- topology_value returns the value of spec.anti_affinity_topology_key of a container, or nil if it has none:
+-- a field of its topology for a well-known key (see arena.TopologyKeyHost), or its label otherwise.
+local function topology_value(fleet, container_id, spec)
+    local value
+    if spec.anti_affinity_topology_field then
+        value = redis.call('HGET', fleet.container_topology_prefix .. container_id, spec.anti_affinity_topology_field)
+    elseif spec.anti_affinity_topology_key then
+        value = redis.call('HGET', fleet.container_labels_prefix .. container_id, spec.anti_affinity_topology_key)
+    end
+    return value or nil
+end
+
+-- violates_anti_affinity reports whether a container, or a container sharing the same topology label
+-- (e.g. host), already hosts a room of the anti-affinity group of spec.
+local function violates_anti_affinity(fleet, container_id, spec)
+    if not spec.anti_affinity_group then
+        return false
+    end
+    local members = redis.call('HKEYS', fleet.anti_affinity_prefix .. spec.anti_affinity_group)
+    if #members == 0 then
+        return false
+    end
+    local topology = topology_value(fleet, container_id, spec)
+    for _, member_id in ipairs(members) do
+        local released = released_of(fleet, member_id, spec)
+        if released and tonumber(redis.call('HGET', fleet.anti_affinity_prefix .. spec.anti_affinity_group, member_id))
+            <= (released.anti_affinity_groups[spec.anti_affinity_group] or 0) then
+            -- All the rooms of the group on the container would be released (dry run)
+        elseif member_id == container_id then
+            return true
+        end
+        if redis.call('EXISTS', fleet.heartbeat_prefix .. member_id) == 0 then
+            -- The container has gone away without releasing its rooms
+            if not spec.dry_run then
+                redis.call('HDEL', fleet.anti_affinity_prefix .. spec.anti_affinity_group, member_id)
+            end
+        elseif topology and topology_value(fleet, member_id, spec) == topology then
+            return true
+        end
+    end
+    return false
+end
+
+-- rejection_reason returns why a container cannot host the room of spec (see allocateRoomScriptRequest),
+-- or nil if it can. spec.region is the region being searched (see search_order).
+local function rejection_reason(fleet, container_id, spec)
+    local released = released_of(fleet, container_id, spec)
+    local capacity = tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id))
+    if capacity and released then
+        capacity = capacity + released.slots
+    end
+    if not capacity or capacity <= 0 then
+        return 'no_capacity'
+    end
+    if redis.call('EXISTS', fleet.heartbeat_prefix .. container_id) == 0 then
+        return 'heartbeat_missing'
+    end
+    if is_penalized(fleet, container_id) then
+        return 'penalized'
+    end
+    if spec.region and container_region(fleet, container_id) ~= spec.region then
+        return 'region_mismatch'
+    end
+    if not match_labels(fleet, container_id, spec.label_selector) then
+        return 'label_mismatch'
+    end
+    if spec.exclusive and redis.call('SCARD', fleet.container_to_rooms_prefix .. container_id) > (released and released.rooms or 0) then
+        return 'not_empty'
+    end
+    if not has_resources(fleet, container_id, spec.resources, released) then
+        return 'insufficient_resources'
+    end
+    if violates_anti_affinity(fleet, container_id, spec) then
+        return 'anti_affinity'
+    end
+    return nil
+end
+
+-- can_host reports whether a live container can host the room of spec:
+-- it has vacancy, is not penalized, matches the label selector, is empty for an exclusive room,
+-- has enough resources and respects anti-affinity.
+local function can_host(fleet, container_id, spec)
+    return rejection_reason(fleet, container_id, spec) == nil
+end
+
+-- find_container returns the container to host the room of spec (see allocateRoomScriptRequest),
+-- skipping the containers in excluded (keyed by fleet name and container ID).
+-- If rejections is given, the candidates that cannot host the room are appended to it with the reason.
+-- If spec.dry_run is set, dead containers are not removed, so that nothing is changed.
+local function find_container(fleet, spec, excluded, rejections)
+    local function check(candidate_id)
+        local reason = rejection_reason(fleet, candidate_id, spec)
+        if reason and rejections then
+            table.insert(rejections, {fleet_name = fleet.name, container_id = candidate_id, reason = reason})
+        end
+        return reason == nil
+    end
+
+    -- Try the preferred container first (e.g. the container of the previous match)
+    local preferred_id = spec.preferred_container_id
+    if preferred_id and not excluded[fleet.name .. ':' .. preferred_id] and check(preferred_id) then
+        return preferred_id
+    end
+
+    -- Prefer the containers that already host a room with the same affinity key
+    if spec.affinity_key then
+        local affinity_key = fleet.affinity_prefix .. spec.affinity_key
+        local preferred = redis.call('HKEYS', affinity_key)
+        table.sort(preferred)
+        for _, candidate_id in ipairs(preferred) do
+            if redis.call('EXISTS', fleet.heartbeat_prefix .. candidate_id) == 0 then
+                -- The container has gone away without releasing its rooms
+                if not spec.dry_run then
+                    redis.call('HDEL', affinity_key, candidate_id)
+                end
+            elseif not excluded[fleet.name .. ':' .. candidate_id] and can_host(fleet, candidate_id, spec) then
+                return candidate_id
+            end
+        end
+    end
+
+    -- Find containers that have vacancy in capacity, ordered by the allocation strategy.
+    -- They are read a page of spec.candidate_count at a time, until a host is found,
+    -- the end of the index is reached or spec.scan_limit containers (if set) have been scanned.
+    -- With preferred zones, the pages are read on until a host in the first preferred zone is found,
+    -- keeping the hosts of the most preferred zone found so far.
+    -- With top_k, one of the first top_k hosts (within the same preferred zone) is picked at random
+    -- so that simultaneous allocations do not all go to the same container.
+    local top_k = spec.top_k or 1
+    local rank = {}
+    for i, zone in ipairs(spec.preferred_zones or {}) do
+        rank[zone] = rank[zone] or i
+    end
+    local function bucket(candidate_id)
+        if not spec.preferred_zones or #spec.preferred_zones == 0 then
+            return 1
+        end
+        return rank[container_zone(fleet, candidate_id)] or #spec.preferred_zones + 1
+    end
+    local hosts = {}
+    local hosts_bucket
+    local offset = 0
+    local scanned = 0
+    -- With the random strategy, the pages start at a random position of the index and wrap around,
+    -- so that any container with vacancy can be picked, not only those of the least capacity
+    local remaining
+    if spec.strategy == 'random' then
+        remaining = redis.call('ZCOUNT', fleet.available_containers_key, '(0', '+inf')
+        if remaining > 0 then
+            offset = math.random(remaining) - 1
+        end
+    end
+    while hosts_bucket ~= 1 and not (spec.scan_limit and scanned >= spec.scan_limit) and remaining ~= 0 do
+        local count = spec.candidate_count
+        if spec.scan_limit then
+            count = math.min(count, spec.scan_limit - scanned)
+        end
+        if remaining then
+            count = math.min(count, remaining)
+        end
+        local found
+        if spec.strategy == 'distributed' then
+            found = redis.call('ZRANGE', fleet.available_containers_key, '+inf', '(0', 'BYSCORE', 'REV', 'LIMIT', offset, count)
+        else
+            found = redis.call('ZRANGE', fleet.available_containers_key, '(0', '+inf', 'BYSCORE', 'LIMIT', offset, count)
+            if remaining and #found < count then
+                -- Wrap around to the beginning of the index
+                offset = -#found
+                for _, candidate_id in ipairs(redis.call('ZRANGE', fleet.available_containers_key, '(0', '+inf', 'BYSCORE', 'LIMIT', 0, count - #found)) do
+                    table.insert(found, candidate_id)
+                end
+            end
+        end
+        scanned = scanned + #found
+        offset = offset + #found
+        if remaining then
+            remaining = remaining - #found
+        end
+        if spec.strategy == 'random' then
+            for i = #found, 2, -1 do
+                local j = math.random(i)
+                found[i], found[j] = found[j], found[i]
+            end
+        end
+
+        -- Check heartbeat for each container and find first alive ones that can host the room.
+        for _, candidate_id in ipairs(found) do
+            if hosts_bucket == 1 and #hosts >= top_k then
+                break
+            end
+            if redis.call('EXISTS', fleet.heartbeat_prefix .. candidate_id) == 0 then
+                -- Remove dead container from available containers
+                if not spec.dry_run then
+                    redis.call('ZREM', fleet.available_containers_key, candidate_id)
+                    -- The next page starts one entry earlier
+                    offset = math.max(offset - 1, 0)
+                end
+                if rejections then
+                    table.insert(rejections, {fleet_name = fleet.name, container_id = candidate_id, reason = 'heartbeat_missing'})
+                end
+            else
+                -- Fill the preferred zones in order, keeping the order of the strategy within each zone
+                local b = bucket(candidate_id)
+                if (not hosts_bucket or b < hosts_bucket or (b == hosts_bucket and #hosts < top_k))
+                    and not excluded[fleet.name .. ':' .. candidate_id] and check(candidate_id) then
+                    if b ~= hosts_bucket then
+                        hosts = {}
+                        hosts_bucket = b
+                    end
+                    table.insert(hosts, candidate_id)
+                end
+            end
+        end
+        if #found == 0 or #found < count then
+            break
+        end
+    end
+    if #hosts <= 1 then
+        return hosts[1]
+    end
+    local weights = {}
+    local total = 0
+    for i, host_id in ipairs(hosts) do
+        weights[i] = 1
+        if spec.top_k_weighting == 'free_capacity' then
+            weights[i] = tonumber(redis.call('ZSCORE', fleet.available_containers_key, host_id))
+        end
+        total = total + weights[i]
+    end
+    local r = math.random() * total
+    for i, host_id in ipairs(hosts) do
+        r = r - weights[i]
+        if r < 0 then
+            return host_id
+        end
+    end
+    return hosts[#hosts]
+end
+
+-- is_turn reports whether the request holding ticket_id (nil if not queued) can allocate a room in the fleet.
+-- Waiting requests are served in order: a request cannot allocate a room in the fleet
+-- while a request queued before it could be placed there (see allocateRoomWaitingForCapacity).
+-- A waiter that cannot be placed (e.g. no container matches its label selector) does not block the requests behind it.
+-- To bound the cost of every allocation, only the first max_turn_waiters waiters are looked at,
+-- each within a single page of its candidates (a waiter placeable only beyond it does not block the others).
+-- If dry_run is set, the tickets of the waiters that have gone away are not removed.
+local max_turn_waiters = 10
+local function is_turn(fleet, ticket_id, dry_run)
+    for _, waiter_id in ipairs(redis.call('ZRANGE', fleet.allocation_queue_key, 0, max_turn_waiters - 1)) do
+        if waiter_id == ticket_id then
+            return true
+        end
+        local waiter = redis.call('GET', fleet.allocation_ticket_prefix .. waiter_id)
+        if not waiter then
+            -- The waiter has gone away without removing its ticket
+            if not dry_run then
+                redis.call('ZREM', fleet.allocation_queue_key, waiter_id)
+            end
+        else
+            local spec = cjson.decode(waiter)
+            spec.dry_run = true
+            spec.scan_limit = spec.candidate_count
+            for _, target in ipairs(search_order({fleet}, spec)) do
+                spec.region = target.region
+                if find_container(fleet, spec, {}) then
+                    return false
+                end
+            end
+        end
+    end
+    return true
+end
+
+-- place_room allocates the room of spec to a container, consuming its capacity and resources.
+-- The state of the room is set by the caller.
+local function place_room(fleet, container_id, spec)
+    local room_key = fleet.room_prefix .. spec.room_id
+    if spec.exclusive then
+        -- Take the whole capacity so that no other room is allocated until the room is released
+        local slots = tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id))
+        redis.call('ZADD', fleet.available_containers_key, 0, container_id)
+        redis.call('HSET', room_key, 'slots', slots)
+    else
+        redis.call('ZINCRBY', fleet.available_containers_key, -1, container_id)
+    end
+    redis.call('SET', fleet.room_container_prefix .. spec.room_id, container_id)
+    redis.call('SADD', fleet.container_to_rooms_prefix .. container_id, spec.room_id)
+    -- Keep the allocation event to send it on commit of a reservation and to tell the initial data (see GetRoom)
+    local allocated_at = now_ms()
+    redis.call('HSET', room_key, 'allocated_at', allocated_at, 'allocation_event', spec.allocation_event)
+    -- Index the room by allocation time to list the rooms (see Metrics.ListRooms)
+    redis.call('ZADD', fleet.room_allocation_times_key, allocated_at, spec.room_id)
+    if spec.properties then
+        set_room_properties(fleet, spec.room_id, spec.properties)
+    end
+    -- Index the room by priority to find the rooms to preempt
+    redis.call('ZADD', fleet.room_priorities_key, spec.priority or 0, spec.room_id)
+    if spec.global_room_registry then
+        redis.call('HSET', fleet.room_registry_key, spec.room_id, fleet.name)
+    end
+
+    -- Consume the resources and remember the amount to return them on release
+    for name, amount in pairs(spec.resources) do
+        redis.call('HINCRBY', fleet.container_resources_prefix .. container_id, name, -amount)
+        redis.call('HSET', room_key, 'resource:' .. name, amount)
+    end
+
+    -- Count the rooms of the affinity key on the container
+    if spec.affinity_key then
+        count_group_room(fleet.affinity_prefix .. spec.affinity_key, container_id, 1)
+        redis.call('HSET', room_key, 'affinity_key', spec.affinity_key)
+    end
+    if spec.anti_affinity_group then
+        count_group_room(fleet.anti_affinity_prefix .. spec.anti_affinity_group, container_id, 1)
+        redis.call('HSET', room_key, 'anti_affinity_group', spec.anti_affinity_group)
+    end
+end
+
+-- can_preempt reports whether a container could host the room of spec if its room victim_id were released.
+-- Only an allocated room (not a reservation) of a live container subscribed to its events is preempted,
+-- so that the container is told to stop the room.
+local function can_preempt(fleet, container_id, victim_id, spec)
+    local victim_key = fleet.room_prefix .. victim_id
+    if redis.call('HGET', victim_key, 'state') ~= 'allocated' then
+        return false
+    end
+    local capacity = tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id))
+    if not capacity or capacity + (tonumber(redis.call('HGET', victim_key, 'slots')) or 1) <= 0 then
+        return false
+    end
+    if redis.call('EXISTS', fleet.heartbeat_prefix .. container_id) == 0 or is_penalized(fleet, container_id) then
+        return false
+    end
+    if spec.region and container_region(fleet, container_id) ~= spec.region then
+        return false
+    end
+    if not match_labels(fleet, container_id, spec.label_selector) then
+        return false
+    end
+    if spec.exclusive and redis.call('SCARD', fleet.container_to_rooms_prefix .. container_id) > 1 then
+        return false
+    end
+    for name, amount in pairs(spec.resources) do
+        local remaining = tonumber(redis.call('HGET', fleet.container_resources_prefix .. container_id, name))
+        local freed = tonumber(redis.call('HGET', victim_key, 'resource:' .. name)) or 0
+        if not remaining or remaining + freed < amount then
+            return false
+        end
+    end
+    if violates_anti_affinity(fleet, container_id, spec) then
+        return false
+    end
+    return redis.call('PUBSUB', 'NUMSUB', fleet.container_channel_prefix .. container_id)[2] > 0
+end
+
+-- find_preemption_victim returns the room of the lowest priority below spec.priority whose release lets
+-- its container host the room of spec, as {room_id, container_id, priority}, or nil if there is none.
+-- The containers in excluded (keyed by fleet name and container ID) are skipped.
+-- The rooms are read page by page as find_container does, until spec.scan_limit rooms (if set) have been scanned.
+local function find_preemption_victim(fleet, spec, excluded)
+    local offset = 0
+    local scanned = 0
+    while not (spec.scan_limit and scanned >= spec.scan_limit) do
+        local count = spec.candidate_count
+        if spec.scan_limit then
+            count = math.min(count, spec.scan_limit - scanned)
+        end
+        local found = redis.call('ZRANGE', fleet.room_priorities_key, '-inf', '(' .. (spec.priority or 0), 'BYSCORE', 'WITHSCORES', 'LIMIT', offset, count)
+        scanned = scanned + #found / 2
+        offset = offset + #found / 2
+        for i = 1, #found, 2 do
+            local room_id = found[i]
+            local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+            if not container_id then
+                -- The room has gone away with its container
+                if not spec.dry_run then
+                    redis.call('ZREM', fleet.room_priorities_key, room_id)
+                    -- The next page starts one entry earlier
+                    offset = math.max(offset - 1, 0)
+                end
+            elseif not excluded[fleet.name .. ':' .. container_id] and can_preempt(fleet, container_id, room_id, spec) then
+                return {room_id = room_id, container_id = container_id, priority = tonumber(found[i + 1])}
+            end
+        end
+        if #found / 2 < count then
+            break
+        end
+    end
+    return nil
+end
+
+-- reap_expired_reservations releases the rooms whose reservation has expired.
+-- The number of rooms released at once is limited to keep the script short; the rest are released next time.
+local function reap_expired_reservations(fleet)
+    local expired = redis.call('ZRANGE', fleet.reservations_key, '-inf', now_ms(), 'BYSCORE', 'LIMIT', '0', '100')
+    for _, room_id in ipairs(expired) do
+        local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+        if container_id then
+            release_room(fleet, container_id, room_id)
+        else
+            redis.call('ZREM', fleet.reservations_key, room_id)
+        end
+    end
+end
+
+-- reap_preempted_rooms releases the preempted rooms whose grace period has passed,
+-- so that the rooms that preempted them take over their slots (see release_room).
+local function reap_preempted_rooms(fleet)
+    local expired = redis.call('ZRANGE', fleet.preempted_rooms_key, '-inf', now_ms(), 'BYSCORE', 'LIMIT', '0', '100')
+    for _, room_id in ipairs(expired) do
+        local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+        if container_id then
+            release_room(fleet, container_id, room_id)
+        else
+            redis.call('ZREM', fleet.preempted_rooms_key, room_id)
+        end
+    end
+end
+
+-- released_by_reaping returns what the rooms due for reaping (see clean_up_fleet) would return to their containers
+-- if they were released, keyed by fleet name and container ID, without releasing them (see explainAllocationScript).
+-- The slot of a preempted room is taken over by the pending room that preempted it, absorbing it if exclusive.
+local function released_by_reaping(fleet, released)
+    local now = now_ms()
+    for _, key in ipairs({fleet.reservations_key, fleet.preempted_rooms_key}) do
+        for _, room_id in ipairs(redis.call('ZRANGE', key, '-inf', now, 'BYSCORE', 'LIMIT', '0', '100')) do
+            local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+            if container_id then
+                local r = released[fleet.name .. ':' .. container_id] or {slots = 0, rooms = 0, resources = {}, anti_affinity_groups = {}}
+                released[fleet.name .. ':' .. container_id] = r
+                local room_key = fleet.room_prefix .. room_id
+                local slots = 1
+                local fields = redis.call('HGETALL', room_key)
+                for i = 1, #fields, 2 do
+                    local name = string.match(fields[i], '^resource:(.+)$')
+                    if fields[i] == 'slots' then
+                        slots = tonumber(fields[i + 1])
+                    elseif name then
+                        r.resources[name] = (r.resources[name] or 0) + tonumber(fields[i + 1])
+                    elseif fields[i] == 'anti_affinity_group' then
+                        r.anti_affinity_groups[fields[i + 1]] = (r.anti_affinity_groups[fields[i + 1]] or 0) + 1
+                    end
+                end
+                local preempted_by = redis.call('HGET', room_key, 'preempted_by')
+                if not (preempted_by and redis.call('HGET', fleet.room_prefix .. preempted_by, 'slots')) then
+                    r.slots = r.slots + slots
+                end
+                r.rooms = r.rooms + 1
+            end
+        end
+    end
+    return released
+end
+
+-- clean_up_fleet removes the expired reservations, preempted rooms and penalties of a fleet before allocation.
+local function clean_up_fleet(fleet)
+    reap_expired_reservations(fleet)
+    reap_preempted_rooms(fleet)
+    redis.call('ZREMRANGEBYSCORE', fleet.container_penalty_key, '-inf', now_ms())
+end
+`
+
+// newLuaScript returns a Lua script with luaLibrary prepended to body.
+func newLuaScript(body string) *rueidis.Lua {
+	return rueidis.NewLuaScript(luaLibrary + body)
+}
@@ -2,14 +2,60 @@ package arenaredis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+const (
+	defaultListRoomsLimit = 100
+)
+
+var (
+	reapExpiredReservationsScript = newLuaScript(`
+reap_expired_reservations(load_fleets({ARGV[1]})[1])
+return 0
+`)
 )
 
 type ContainerCapacity struct {
 	ContainerID string
 	Capacity    int
+	// Resources is the remaining amount of named resources declared by AddContainerRequest.Resources.
+	Resources map[string]int
+}
+
+// ListRoomsRequest is the parameter of Metrics.ListRooms.
+type ListRoomsRequest struct {
+	FleetName string
+	// ContainerID lists only the rooms of the container, if not empty.
+	ContainerID string
+	// AllocatedAfter and AllocatedBefore list only the rooms allocated in [AllocatedAfter, AllocatedBefore).
+	// The zero value means no bound.
+	AllocatedAfter  time.Time
+	AllocatedBefore time.Time
+	// Cursor is ListRoomsResponse.NextCursor of the previous page, or empty for the first page.
+	Cursor string
+	// Limit is the maximum number of rooms in a page. Defaults to 100.
+	Limit int
+}
+
+type ListRoomsResponse struct {
+	Rooms []RoomSummary
+	// NextCursor is the cursor of the next page, or empty if all the rooms have been listed.
+	NextCursor string
+}
+
+type RoomSummary struct {
+	RoomID      string
+	ContainerID string
+	State       arena.RoomState
+	AllocatedAt time.Time
 }
 
 type Metrics struct {
@@ -35,9 +81,30 @@ func (m *Metrics) GetContainerCount(ctx context.Context, fleetName string) (int,
 	return int(count), nil
 }
 
+// GetAllocationQueueLength returns the number of requests waiting for capacity in the fleet.
+func (m *Metrics) GetAllocationQueueLength(ctx context.Context, fleetName string) (int, error) {
+	key := redisKeyAllocationQueue(m.keyPrefix, fleetName)
+	cmd := m.client.B().Zcard().Key(key).Build()
+	res := m.client.Do(ctx, cmd)
+	if err := res.Error(); err != nil {
+		return 0, fmt.Errorf("failed to zcard allocation queue: %w", err)
+	}
+	count, err := res.AsInt64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse allocation queue length as int64: %w", err)
+	}
+	return int(count), nil
+}
+
 func (m *Metrics) GetContainers(ctx context.Context, fleetName string) ([]ContainerCapacity, error) {
 	key := redisKeyAvailableContainersIndex(m.keyPrefix, fleetName)
 
+	// Return the capacity of expired reservations before reading it
+	reapCmd := reapExpiredReservationsScript.Exec(ctx, m.client, fleetScriptKeys(m.keyPrefix, fleetName), []string{fleetName})
+	if err := reapCmd.Error(); err != nil {
+		return nil, fmt.Errorf("failed to reap expired reservations: %w", err)
+	}
+
 	// Get all containers (including capacity: 0) to check for expired ones
 	cmd := m.client.B().Zrange().Key(key).Min("-inf").Max("+inf").Byscore().Withscores().Build()
 	res := m.client.Do(ctx, cmd)
@@ -72,6 +139,26 @@ func (m *Metrics) GetContainers(ctx context.Context, fleetName string) ([]Contai
 		}
 	}
 
+	// Fill in the remaining resources of each container
+	if len(containers) > 0 {
+		cmds := make(rueidis.Commands, 0, len(containers))
+		for _, c := range containers {
+			cmds = append(cmds, m.client.B().Hgetall().Key(redisKeyContainerResources(m.keyPrefix, fleetName, c.ContainerID)).Build())
+		}
+		for i, res := range m.client.DoMulti(ctx, cmds...) {
+			resources, err := res.AsIntMap()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get resources of container '%s': %w", containers[i].ContainerID, err)
+			}
+			if len(resources) > 0 {
+				containers[i].Resources = make(map[string]int, len(resources))
+				for name, amount := range resources {
+					containers[i].Resources[name] = int(amount)
+				}
+			}
+		}
+	}
+
 	// Remove expired containers from the index
 	if len(expiredContainerIDs) > 0 {
 		zremCmd := m.client.B().Zrem().Key(key).Member(expiredContainerIDs...).Build()
@@ -82,3 +169,150 @@ func (m *Metrics) GetContainers(ctx context.Context, fleetName string) ([]Contai
 
 	return containers, nil
 }
+
+// ListRooms returns a page of the rooms of a fleet, oldest first.
+// With ContainerID, the rooms of the container are scanned in no particular order instead,
+// and a page may have fewer rooms than Limit (even none) before the last one.
+// Each page is read by a few bounded commands, so listing a large fleet does not block Redis,
+// but rooms allocated or released while paging may or may not be listed.
+func (m *Metrics) ListRooms(ctx context.Context, req ListRoomsRequest) (*ListRoomsResponse, error) {
+	if req.FleetName == "" {
+		return nil, errors.New("missing fleet name")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultListRoomsLimit
+	}
+	cursor, err := decodeRoomListCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if req.ContainerID != "" {
+		return m.listContainerRooms(ctx, req, limit, cursor)
+	}
+	return m.listRoomsByAllocationTime(ctx, req, limit, cursor)
+}
+
+// listRoomsByAllocationTime pages through the rooms in the allocation time index.
+// The cursor is the last room listed, so that the next page starts right after it even if rooms are released.
+func (m *Metrics) listRoomsByAllocationTime(ctx context.Context, req ListRoomsRequest, limit int, cursor roomListCursor) (*ListRoomsResponse, error) {
+	key := redisKeyRoomAllocationTimes(m.keyPrefix, req.FleetName)
+	minScore := "-inf"
+	if !req.AllocatedAfter.IsZero() {
+		minScore = strconv.FormatInt(req.AllocatedAfter.UnixMilli(), 10)
+	}
+	if cursor.RoomID != "" && (req.AllocatedAfter.IsZero() || cursor.AllocatedAtMs > req.AllocatedAfter.UnixMilli()) {
+		minScore = strconv.FormatInt(cursor.AllocatedAtMs, 10)
+	}
+	maxScore := "+inf"
+	if !req.AllocatedBefore.IsZero() {
+		maxScore = "(" + strconv.FormatInt(req.AllocatedBefore.UnixMilli(), 10)
+	}
+
+	// Read the index in batches until a room beyond the page is found (more) or the index is exhausted
+	var found []rueidis.ZScore
+	more := false
+	for offset := int64(0); ; {
+		cmd := m.client.B().Zrange().Key(key).Min(minScore).Max(maxScore).Byscore().Limit(offset, int64(limit)).Withscores().Build()
+		scores, err := m.client.Do(ctx, cmd).AsZScores()
+		if err != nil {
+			return nil, fmt.Errorf("failed to zrange room allocation times: %w", err)
+		}
+		for _, score := range scores {
+			// Skip the rooms up to the cursor allocated at the same time; they are ordered by room ID
+			if cursor.RoomID != "" && int64(score.Score) == cursor.AllocatedAtMs && score.Member <= cursor.RoomID {
+				continue
+			}
+			if len(found) == limit {
+				more = true
+				break
+			}
+			found = append(found, score)
+		}
+		offset += int64(len(scores))
+		if more || len(scores) < limit {
+			break
+		}
+	}
+
+	roomIDs := make([]string, 0, len(found))
+	for _, score := range found {
+		roomIDs = append(roomIDs, score.Member)
+	}
+	rooms, err := m.getRoomSummaries(ctx, req.FleetName, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ListRoomsResponse{Rooms: rooms}
+	if more {
+		last := found[len(found)-1]
+		resp.NextCursor = encodeRoomListCursor(roomListCursor{AllocatedAtMs: int64(last.Score), RoomID: last.Member})
+	}
+	return resp, nil
+}
+
+// listContainerRooms pages through the rooms of a container by SSCAN.
+func (m *Metrics) listContainerRooms(ctx context.Context, req ListRoomsRequest, limit int, cursor roomListCursor) (*ListRoomsResponse, error) {
+	key := redisKeyContainerToRooms(m.keyPrefix, req.FleetName, req.ContainerID)
+	cmd := m.client.B().Sscan().Key(key).Cursor(cursor.ScanCursor).Count(int64(limit)).Build()
+	entry, err := m.client.Do(ctx, cmd).AsScanEntry()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sscan rooms of container '%s': %w", req.ContainerID, err)
+	}
+	rooms, err := m.getRoomSummaries(ctx, req.FleetName, entry.Elements)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ListRoomsResponse{}
+	for _, room := range rooms {
+		if !req.AllocatedAfter.IsZero() && room.AllocatedAt.Before(req.AllocatedAfter) {
+			continue
+		}
+		if !req.AllocatedBefore.IsZero() && !room.AllocatedAt.Before(req.AllocatedBefore) {
+			continue
+		}
+		resp.Rooms = append(resp.Rooms, room)
+	}
+	if entry.Cursor != 0 {
+		resp.NextCursor = encodeRoomListCursor(roomListCursor{ScanCursor: entry.Cursor})
+	}
+	return resp, nil
+}
+
+// getRoomSummaries returns the rooms in order, skipping the rooms released in the meantime.
+func (m *Metrics) getRoomSummaries(ctx context.Context, fleetName string, roomIDs []string) ([]RoomSummary, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	cmds := make(rueidis.Commands, 0, len(roomIDs)*2)
+	for _, roomID := range roomIDs {
+		cmds = append(cmds,
+			m.client.B().Get().Key(redisKeyRoomToContainer(m.keyPrefix, fleetName, roomID)).Build(),
+			m.client.B().Hmget().Key(redisKeyRoom(m.keyPrefix, fleetName, roomID)).Field("state", "allocated_at").Build())
+	}
+	results := m.client.DoMulti(ctx, cmds...)
+	var rooms []RoomSummary
+	for i, roomID := range roomIDs {
+		containerID, err := results[i*2].ToString()
+		if err != nil {
+			if rueidis.IsRedisNil(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get container of room '%s': %w", roomID, err)
+		}
+		fields, err := results[i*2+1].ToArray()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+		}
+		room := RoomSummary{RoomID: roomID, ContainerID: containerID}
+		if state, err := fields[0].ToString(); err == nil {
+			room.State = arena.RoomState(state)
+		}
+		// Rooms allocated by an older version have no allocation time
+		if allocatedAt, err := fields[1].AsInt64(); err == nil {
+			room.AllocatedAt = time.UnixMilli(allocatedAt)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
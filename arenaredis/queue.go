@@ -0,0 +1,168 @@
+package arenaredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+const (
+	defaultAllocationQueuePollInterval = 1 * time.Second
+	// allocationTicketTTLFactor decides the TTL of an allocation ticket relative to the poll interval.
+	// A ticket whose waiter has gone away is removed from the queue after the TTL.
+	allocationTicketTTLFactor = 5
+)
+
+var (
+	// enqueueAllocationTicketScript adds a ticket to the allocation queue in weighted fair order.
+	// Each ticket is scored by its virtual finish time (weighted fair queueing):
+	// a tenant's tickets are spaced by 1/weight, starting from the virtual time of the last served ticket.
+	// Tickets of a single tenant are therefore served in FIFO order,
+	// while tickets of multiple tenants are interleaved in proportion to their weights.
+	// The ticket holds the allocation request, so that others can tell whether the waiter could be placed (see is_turn).
+	enqueueAllocationTicketScript = rueidis.NewLuaScript(`
+local allocation_queue_key = KEYS[1]
+local allocation_queue_vtime_key = KEYS[2]
+local allocation_ticket_key = KEYS[3]
+local ticket_id = ARGV[1]
+local ticket_ttl_ms = ARGV[2]
+local tenant_field = 'tenant:' .. ARGV[3]
+local weight = tonumber(ARGV[4])
+
+local now = tonumber(redis.call('HGET', allocation_queue_vtime_key, 'now') or '0')
+local last_finish = tonumber(redis.call('HGET', allocation_queue_vtime_key, tenant_field) or '0')
+local finish = math.max(now, last_finish) + 1 / weight
+redis.call('HSET', allocation_queue_vtime_key, tenant_field, finish)
+redis.call('ZADD', allocation_queue_key, finish, ticket_id)
+redis.call('SET', allocation_ticket_key, ARGV[5], 'PX', ticket_ttl_ms)
+return 0
+`)
+
+	dequeueAllocationTicketScript = rueidis.NewLuaScript(`
+local allocation_queue_key = KEYS[1]
+local allocation_queue_vtime_key = KEYS[2]
+local allocation_ticket_key = KEYS[3]
+local capacity_channel = KEYS[4]
+local ticket_id = ARGV[1]
+local fleet_name = ARGV[2]
+
+redis.call('ZREM', allocation_queue_key, ticket_id)
+redis.call('DEL', allocation_ticket_key)
+if redis.call('EXISTS', allocation_queue_key) == 0 then
+    -- Nobody is waiting; reset the virtual time
+    redis.call('DEL', allocation_queue_vtime_key)
+else
+    -- Wake up the next waiter in case this ticket was at the head of the queue
+    redis.call('PUBLISH', capacity_channel, fleet_name)
+end
+return 0
+`)
+)
+
+// allocateRoomWaitingForCapacity parks the request in the allocation queue of the fleet
+// and retries the allocation whenever capacity frees up, until the room is allocated or ctx is done.
+func (a *redisFrontend) allocateRoomWaitingForCapacity(ctx context.Context, req arena.AllocateRoomRequest, reservationTTL time.Duration) (*allocateRoomScriptResult, error) {
+	subCtx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	fleetNames := append([]string{req.FleetName}, req.FallbackFleetNames...)
+	notified := a.subscribeCapacity(subCtx, fleetNames)
+
+	// UUIDv7 is time-ordered, so that tickets with the same virtual finish time are served in FIFO order.
+	ticketID := uuid.Must(uuid.NewV7()).String()
+	ticketTTL := a.options.allocationQueuePollInterval * allocationTicketTTLFactor
+	if err := a.enqueueAllocationTicket(ctx, req, reservationTTL, ticketID, ticketTTL); err != nil {
+		return nil, err
+	}
+	defer a.dequeueAllocationTicket(context.WithoutCancel(ctx), req.FleetName, ticketID)
+
+	for {
+		result, err := a.allocateRoom(ctx, req, reservationTTL, ticketID)
+		if err == nil {
+			return result, nil
+		}
+		if !arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, arena.NewError(arena.ErrorStatusResourceExhausted, fmt.Errorf("no available container until context done: %w", ctx.Err()))
+		case <-notified:
+		case <-time.After(a.options.allocationQueuePollInterval):
+		}
+		// keep the ticket alive while waiting
+		key := redisKeyAllocationTicket(a.keyPrefix, req.FleetName, ticketID)
+		cmd := a.client.B().Pexpire().Key(key).Milliseconds(ticketTTL.Milliseconds()).Build()
+		if err := a.client.Do(ctx, cmd).Error(); err != nil && !errors.Is(err, ctx.Err()) {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to refresh allocation ticket: %w", err))
+		}
+	}
+}
+
+func (a *redisFrontend) enqueueAllocationTicket(ctx context.Context, req arena.AllocateRoomRequest, reservationTTL time.Duration, ticketID string, ttl time.Duration) error {
+	scriptReq, err := a.newAllocateRoomScriptRequest(req)
+	if err != nil {
+		return err
+	}
+	scriptReq.ReservationTTLMs = reservationTTL.Milliseconds()
+	encodedReq, err := encodeAllocateRoomScriptRequest(scriptReq)
+	if err != nil {
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation request: %w", err))
+	}
+	weight := req.TenantWeight
+	if weight == 0 {
+		weight = 1
+	}
+	res := enqueueAllocationTicketScript.Exec(ctx, a.client, []string{
+		redisKeyAllocationQueue(a.keyPrefix, req.FleetName),
+		redisKeyAllocationQueueVirtualTime(a.keyPrefix, req.FleetName),
+		redisKeyAllocationTicket(a.keyPrefix, req.FleetName, ticketID),
+	}, []string{ticketID, strconv.FormatInt(ttl.Milliseconds(), 10), req.Tenant, strconv.Itoa(weight), encodedReq})
+	if err := res.Error(); err != nil {
+		return arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to enqueue allocation ticket: %w", err))
+	}
+	return nil
+}
+
+// dequeueAllocationTicket removes the ticket from the queue and wakes up the next waiter.
+func (a *redisFrontend) dequeueAllocationTicket(ctx context.Context, fleetName, ticketID string) {
+	res := dequeueAllocationTicketScript.Exec(ctx, a.client, []string{
+		redisKeyAllocationQueue(a.keyPrefix, fleetName),
+		redisKeyAllocationQueueVirtualTime(a.keyPrefix, fleetName),
+		redisKeyAllocationTicket(a.keyPrefix, fleetName, ticketID),
+		redisPubSubChannelCapacity(a.keyPrefix, fleetName),
+	}, []string{ticketID, fleetName})
+	if err := res.Error(); err != nil {
+		slog.WarnContext(ctx, fmt.Sprintf("failed to dequeue allocation ticket '%s': %+v", ticketID, err), "error", err)
+	}
+}
+
+// subscribeCapacity returns a channel that is notified when capacity may have been freed up in the fleets.
+// Notifications are best-effort; waiters also retry periodically.
+func (a *redisFrontend) subscribeCapacity(ctx context.Context, fleetNames []string) <-chan struct{} {
+	notified := make(chan struct{}, 1)
+	channels := make([]string, 0, len(fleetNames))
+	for _, fleetName := range fleetNames {
+		channels = append(channels, redisPubSubChannelCapacity(a.keyPrefix, fleetName))
+	}
+	go func() {
+		cmd := a.client.B().Subscribe().Channel(channels...).Build()
+		err := a.client.Receive(ctx, cmd, func(_ rueidis.PubSubMessage) {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, fmt.Sprintf("failed to subscribe capacity channels: %+v", err), "error", err)
+		}
+	}()
+	return notified
+}
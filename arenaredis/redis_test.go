@@ -1,6 +1,7 @@
 package arenaredis
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -108,6 +109,1458 @@ func TestAllocateRoomDuplicated(t *testing.T) {
 	mustTimeoutChan(t, con1.EventChannel, 1*time.Second)
 }
 
+func TestAllocationWithLabelSelector(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name,
+		Labels: map[string]string{"map": "desert", "build": "stable"}})
+	require.NoError(t, err)
+	con2, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 2, FleetName: fleet1Name,
+		Labels: map[string]string{"map": "forest", "build": "canary", "gpu": "true"}})
+	require.NoError(t, err)
+
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name,
+		LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"map": "forest"}}})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room1.ContainerID)
+	ev := mustReadChan(t, con2.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room1", ev.RoomID)
+
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name,
+		LabelSelector: arena.LabelSelector{MatchExpressions: []arena.LabelSelectorRequirement{
+			{Key: "build", Operator: arena.LabelSelectorOpNotIn, Values: []string{"canary"}},
+		}}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room2.ContainerID)
+	ev = mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room2", ev.RoomID)
+
+	room3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name,
+		LabelSelector: arena.LabelSelector{MatchExpressions: []arena.LabelSelectorRequirement{
+			{Key: "gpu", Operator: arena.LabelSelectorOpExists},
+			{Key: "map", Operator: arena.LabelSelectorOpIn, Values: []string{"desert", "forest"}},
+		}}})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room3.ContainerID)
+
+	// con2 is full; no other container has a GPU
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name,
+		LabelSelector: arena.LabelSelector{MatchExpressions: []arena.LabelSelectorRequirement{
+			{Key: "gpu", Operator: arena.LabelSelectorOpExists},
+		}}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name,
+		LabelSelector: arena.LabelSelector{MatchExpressions: []arena.LabelSelectorRequirement{
+			{Key: "map", Operator: arena.LabelSelectorOpIn},
+		}}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+}
+
+func TestAllocationBeyondCandidateWindow(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithCandidateContainerMaxCount(2))
+
+	// only the last container in the index matches
+	for _, containerID := range []string{"con1", "con2", "con3", "con4"} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: containerID, InitialCapacity: 1, FleetName: fleet1Name})
+		require.NoError(t, err)
+	}
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con5", InitialCapacity: 1, FleetName: fleet1Name,
+		Labels: map[string]string{"gpu": "true"}})
+	require.NoError(t, err)
+	selector := arena.LabelSelector{MatchLabels: map[string]string{"gpu": "true"}}
+
+	// candidates are read page by page
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, LabelSelector: selector})
+	require.NoError(t, err)
+	require.Equal(t, "con5", room1.ContainerID)
+
+	// but no further than the scan limit
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con6", InitialCapacity: 1, FleetName: fleet1Name,
+		Labels: map[string]string{"gpu": "true"}})
+	require.NoError(t, err)
+	limitedFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client,
+		WithCandidateContainerMaxCount(2), WithCandidateContainerScanLimit(3))
+	_, err = limitedFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, LabelSelector: selector})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, LabelSelector: selector})
+	require.NoError(t, err)
+	require.Equal(t, "con6", room2.ContainerID)
+}
+
+func TestAllocationStrategy(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithAllocationStrategy(arena.AllocationStrategyDistributed))
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// Distributed (frontend default): the container with the most free capacity first
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+
+	// Packed (per request): the container with the least free capacity first
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, Strategy: arena.AllocationStrategyPacked})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room2.ContainerID)
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: "room2"}))
+
+	// Random: both containers are eventually chosen
+	chosen := map[string]struct{}{}
+	for i := 0; i < 50 && len(chosen) < 2; i++ {
+		roomID := fmt.Sprintf("random-room%d", i)
+		resp, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name, Strategy: arena.AllocationStrategyRandom})
+		require.NoError(t, err)
+		chosen[resp.ContainerID] = struct{}{}
+		require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: resp.ContainerID, FleetName: fleet1Name, RoomID: roomID}))
+	}
+	require.Len(t, chosen, 2)
+
+	// Random with one candidate per page: the container of the most free capacity is still chosen
+	pagedFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client, WithCandidateContainerMaxCount(1))
+	chosen = map[string]struct{}{}
+	for i := 0; i < 50 && len(chosen) < 2; i++ {
+		roomID := fmt.Sprintf("paged-random-room%d", i)
+		resp, err := pagedFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name, Strategy: arena.AllocationStrategyRandom})
+		require.NoError(t, err)
+		chosen[resp.ContainerID] = struct{}{}
+		require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: resp.ContainerID, FleetName: fleet1Name, RoomID: roomID}))
+	}
+	require.Len(t, chosen, 2)
+
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name, Strategy: "unknown"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+}
+
+func TestAllocationWithResources(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 4, FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 24000, "cpu_milli": 4000}})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 4, FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 8000, "cpu_milli": 4000}})
+	require.NoError(t, err)
+
+	// con1: gpu_mem_mb 24000 -> 8000
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 16000}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+
+	// Both containers have only small gaps left
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 16000}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// Unknown resources cannot be satisfied by any container
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name,
+		Resources: map[string]int{"tpu": 1}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// con1: gpu_mem_mb 8000 -> 0, cpu_milli 4000 -> 3000
+	room3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 8000, "cpu_milli": 1000}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room3.ContainerID)
+
+	containers, err := metrics.GetContainers(ctx, fleet1Name)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []ContainerCapacity{
+		{ContainerID: "con1", Capacity: 2, Resources: map[string]int{"gpu_mem_mb": 0, "cpu_milli": 3000}},
+		{ContainerID: "con2", Capacity: 4, Resources: map[string]int{"gpu_mem_mb": 8000, "cpu_milli": 4000}},
+	}, containers)
+
+	// Releasing room1 returns its resources; releasing it twice does not.
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	containers, err = metrics.GetContainers(ctx, fleet1Name)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []ContainerCapacity{
+		{ContainerID: "con1", Capacity: 3, Resources: map[string]int{"gpu_mem_mb": 16000, "cpu_milli": 3000}},
+		{ContainerID: "con2", Capacity: 4, Resources: map[string]int{"gpu_mem_mb": 8000, "cpu_milli": 4000}},
+	}, containers)
+
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name,
+		Resources: map[string]int{"gpu_mem_mb": 16000}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room2.ContainerID)
+}
+
+func TestAllocationWithFallbackFleets(t *testing.T) {
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	conA, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "conA", InitialCapacity: 1, FleetName: "fleetA"})
+	require.NoError(t, err)
+	conC, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "conC", InitialCapacity: 1, FleetName: "fleetC"})
+	require.NoError(t, err)
+
+	req := func(roomID string) arena.AllocateRoomRequest {
+		return arena.AllocateRoomRequest{RoomID: roomID, FleetName: "fleetA", FallbackFleetNames: []string{"fleetB", "fleetC"}}
+	}
+
+	// the primary fleet has vacancy
+	room1, err := frontend.AllocateRoom(ctx, req("room1"))
+	require.NoError(t, err)
+	require.Equal(t, "conA", room1.ContainerID)
+	require.Equal(t, "fleetA", room1.FleetName)
+	_ = mustReadChan(t, conA.EventChannel)
+
+	// fleetA is full and fleetB has no container, so fleetC is used
+	room2, err := frontend.AllocateRoom(ctx, req("room2"))
+	require.NoError(t, err)
+	require.Equal(t, "conC", room2.ContainerID)
+	require.Equal(t, "fleetC", room2.FleetName)
+	_ = mustReadChan(t, conC.EventChannel)
+
+	// allocating the same room again returns the fleet it was allocated in
+	room2, err = frontend.AllocateRoom(ctx, req("room2"))
+	require.NoError(t, err)
+	require.Equal(t, "conC", room2.ContainerID)
+	require.Equal(t, "fleetC", room2.FleetName)
+
+	_, err = frontend.AllocateRoom(ctx, req("room3"))
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// the room works against the fleet it was allocated in
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room2", FleetName: room2.FleetName, Body: []byte("hello")})
+	require.NoError(t, err)
+	ev := mustReadChan(t, conC.EventChannel).(*arena.NotifyToRoomEvent)
+	require.Equal(t, "room2", ev.RoomID)
+	err = backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "conC", FleetName: room2.FleetName, RoomID: "room2"})
+	require.NoError(t, err)
+	room3, err := frontend.AllocateRoom(ctx, req("room3"))
+	require.NoError(t, err)
+	require.Equal(t, "fleetC", room3.FleetName)
+
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: "fleetA", FallbackFleetNames: []string{"fleetA"}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+}
+
+func TestAllocationWaitForCapacity(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	room2 := allocateRoomAsync(ctx, frontend, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, WaitForCapacity: true})
+	requireAllocationQueueLength(t, metrics, fleet1Name, 1)
+	room3 := allocateRoomAsync(ctx, frontend, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name, WaitForCapacity: true})
+	requireAllocationQueueLength(t, metrics, fleet1Name, 2)
+
+	// requests without waiting do not overtake the queue
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// capacity from ReleaseRoom goes to the first waiter
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	res := mustReadChan(t, room2)
+	require.NoError(t, res.err)
+	require.Equal(t, "con1", res.resp.ContainerID)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 1)
+
+	// capacity from AddContainer goes to the next waiter
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	res = mustReadChan(t, room3)
+	require.NoError(t, res.err)
+	require.Equal(t, "con2", res.resp.ContainerID)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 0)
+
+	// the waiter gives up when the context is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	_, err = frontend.AllocateRoom(timeoutCtx, arena.AllocateRoomRequest{RoomID: "room5", FleetName: fleet1Name, WaitForCapacity: true})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	requireAllocationQueueLength(t, metrics, fleet1Name, 0)
+}
+
+func TestAllocationWaitForCapacityUnplaceableWaiter(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name,
+		Labels: map[string]string{"version": "v1"}})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// no container matches the selector of the first waiter
+	room2 := allocateRoomAsync(ctx, frontend, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, WaitForCapacity: true,
+		LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"version": "v2"}}})
+	requireAllocationQueueLength(t, metrics, fleet1Name, 1)
+	room3 := allocateRoomAsync(ctx, frontend, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name, WaitForCapacity: true})
+	requireAllocationQueueLength(t, metrics, fleet1Name, 2)
+
+	// the capacity goes to the waiter behind it
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	res := mustReadChan(t, room3)
+	require.NoError(t, res.err)
+	require.Equal(t, "con1", res.resp.ContainerID)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 1)
+
+	// requests without waiting are not blocked either
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	resp, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", resp.ContainerID)
+
+	// the first waiter is served once a container matches
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con3", InitialCapacity: 1, FleetName: fleet1Name,
+		Labels: map[string]string{"version": "v2"}})
+	require.NoError(t, err)
+	res = mustReadChan(t, room2)
+	require.NoError(t, res.err)
+	require.Equal(t, "con3", res.resp.ContainerID)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 0)
+}
+
+func TestAllocationWaitForCapacityWeightedFairShare(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room0", FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	allocated := make(chan string, 5)
+	waitAllocation := func(roomID, tenant string, weight int) {
+		res := allocateRoomAsync(ctx, frontend, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name,
+			WaitForCapacity: true, Tenant: tenant, TenantWeight: weight})
+		go func() {
+			if (<-res).err == nil {
+				allocated <- roomID
+			}
+		}()
+	}
+
+	// The noisy tenant queues first, but the other tenants are not starved.
+	waitAllocation("noisy1", "noisy", 1)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 1)
+	waitAllocation("noisy2", "noisy", 1)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 2)
+	waitAllocation("noisy3", "noisy", 1)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 3)
+	waitAllocation("quiet1", "quiet", 1)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 4)
+	waitAllocation("vip1", "vip", 2)
+	requireAllocationQueueLength(t, metrics, fleet1Name, 5)
+
+	// virtual finish time: vip1=0.5, noisy1=1, quiet1=1, noisy2=2, noisy3=3
+	releasing := "room0"
+	for _, expected := range []string{"vip1", "noisy1", "quiet1", "noisy2", "noisy3"} {
+		require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: releasing}))
+		releasing = mustReadChan(t, allocated)
+		require.Equal(t, expected, releasing)
+	}
+	requireAllocationQueueLength(t, metrics, fleet1Name, 0)
+}
+
+func TestReserveRoom(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// a reservation holds the slot without notifying the container
+	room1, err := frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, RoomInitialData: []byte("hello")}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+	require.Equal(t, fleet1Name, room1.FleetName)
+	require.False(t, room1.ExpiresAt.IsZero())
+	mustTimeoutChan(t, con1.EventChannel, 500*time.Millisecond)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// a reserved room cannot be allocated without committing it
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+
+	// committing sends the AllocationEvent
+	require.NoError(t, frontend.CommitReservation(ctx, arena.CommitReservationRequest{RoomID: "room1", FleetName: fleet1Name}))
+	ev := mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room1", ev.RoomID)
+	require.Equal(t, "hello", string(ev.RoomInitialData))
+	err = frontend.CommitReservation(ctx, arena.CommitReservationRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+
+	// cancelling returns the capacity
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name}})
+	require.NoError(t, err)
+	require.NoError(t, frontend.CancelReservation(ctx, arena.CancelReservationRequest{RoomID: "room2", FleetName: fleet1Name}))
+	err = frontend.CancelReservation(ctx, arena.CancelReservationRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	mustTimeoutChan(t, con1.EventChannel, 500*time.Millisecond)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name})
+	require.NoError(t, err)
+	_ = mustReadChan(t, con1.EventChannel)
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room3"}))
+
+	// an expired reservation returns the capacity automatically
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name}, TTL: 500 * time.Millisecond})
+	require.NoError(t, err)
+	time.Sleep(1 * time.Second)
+	err = frontend.CommitReservation(ctx, arena.CommitReservationRequest{RoomID: "room4", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	room5, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room5", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room5.ContainerID)
+	ev = mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room5", ev.RoomID)
+}
+
+func TestAllocationWithAck(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	// a timeout that would be truncated to 0 (infinite) is rejected
+	_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, AckTimeout: time.Microsecond})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	con2, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// con2 acks the allocation, but con1 does not
+	go func() {
+		if ev, ok := (<-con2.EventChannel).(*arena.AllocationEvent); ok {
+			_ = backend.AckAllocation(ctx, arena.AckAllocationRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: ev.RoomID})
+		}
+	}()
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, AckTimeout: 500 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room1.ContainerID)
+
+	// the late ack of con1 is rejected because the room has been re-placed
+	ev := mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room1", ev.RoomID)
+	err = backend.AckAllocation(ctx, arena.AckAllocationRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	// nor does the release by con1 remove the room from con2
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	require.NoError(t, frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room1", FleetName: fleet1Name, Body: []byte("hello_room1")}))
+
+	// con1 is penalized even though its capacity has been returned
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// the release by con2 returns its capacity
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: "room1"}))
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room2.ContainerID)
+}
+
+func TestAllocationSkipsUnsubscribedContainer(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	con2, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "reserved", FleetName: fleet1Name}, TTL: time.Minute})
+	require.NoError(t, err)
+
+	// con1 keeps its heartbeat but loses its subscription (e.g. the backend instance holding it died)
+	unsubscribeContainer(t, frontend, backend, fleet1Name, "con1")
+
+	// the reservation on con1 cannot be committed and is released
+	err = frontend.CommitReservation(ctx, arena.CommitReservationRequest{RoomID: "reserved", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	_, err = frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "reserved", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// packed strategy prefers con1, but the room is placed on con2 instead
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room1.ContainerID)
+	ev := mustReadChan(t, con2.EventChannel).(*arena.AllocationEvent)
+	require.Equal(t, "room1", ev.RoomID)
+
+	// con1 is suspect and excluded from allocation
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room2.ContainerID)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+}
+
+func TestAllocateRooms(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+	con2, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// all or none: 6 rooms do not fit in the capacity of 5
+	var rooms []arena.AllocateRoomRequest
+	for i := range 6 {
+		rooms = append(rooms, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("room%d", i), FleetName: fleet1Name})
+	}
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	mustTimeoutChan(t, con1.EventChannel, 500*time.Millisecond)
+	mustTimeoutChan(t, con2.EventChannel, 100*time.Millisecond)
+
+	// same container: only con2 can host 3 rooms
+	resp, err := frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms[:3], Placement: arena.RoomPlacementSameContainer})
+	require.NoError(t, err)
+	require.Len(t, resp.Rooms, 3)
+	for i, room := range resp.Rooms {
+		require.Equal(t, rooms[i].RoomID, room.RoomID)
+		require.Equal(t, "con2", room.ContainerID)
+		require.Equal(t, fleet1Name, room.FleetName)
+		ev := mustReadChan(t, con2.EventChannel).(*arena.AllocationEvent)
+		require.Equal(t, rooms[i].RoomID, ev.RoomID)
+	}
+
+	// distinct containers: con2 is full, so there is only one container left
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms[3:5], Placement: arena.RoomPlacementDistinctContainers})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: "room0"}))
+	resp, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms[3:5], Placement: arena.RoomPlacementDistinctContainers})
+	require.NoError(t, err)
+	require.NotEqual(t, resp.Rooms[0].ContainerID, resp.Rooms[1].ContainerID)
+
+	// retrying returns the rooms as is
+	retried, err := frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms[3:5], Placement: arena.RoomPlacementDistinctContainers})
+	require.NoError(t, err)
+	require.Equal(t, resp, retried)
+
+	// rooms that have partially been allocated are rejected
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: rooms[4:]})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+}
+
+func TestAllocationWithAffinityKey(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithAllocationStrategy(arena.AllocationStrategyDistributed))
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 5, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 5, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// the distributed strategy would spread the rooms, but the affinity key co-locates them
+	lobby, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "lobby", FleetName: fleet1Name, AffinityKey: "party1"})
+	require.NoError(t, err)
+	match, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "match", FleetName: fleet1Name, AffinityKey: "party1"})
+	require.NoError(t, err)
+	require.Equal(t, lobby.ContainerID, match.ContainerID)
+	other, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "other", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.NotEqual(t, lobby.ContainerID, other.ContainerID)
+
+	// the mapping is removed when the last room with the key is released
+	client := frontend.(*redisFrontend).client
+	affinityKey := redisKeyAffinity(frontend.(*redisFrontend).keyPrefix, fleet1Name, "party1")
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: lobby.ContainerID, FleetName: fleet1Name, RoomID: "lobby"}))
+	count, err := client.Do(ctx, client.B().Hget().Key(affinityKey).Field(lobby.ContainerID).Build()).AsInt64()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: match.ContainerID, FleetName: fleet1Name, RoomID: "match"}))
+	exists, err := client.Do(ctx, client.B().Exists().Key(affinityKey).Build()).AsInt64()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), exists)
+
+	// the mapping is also removed when the container is deleted
+	party2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "party2-lobby", FleetName: fleet1Name, AffinityKey: "party2"})
+	require.NoError(t, err)
+	require.NoError(t, backend.DeleteContainer(ctx, arena.DeleteContainerRequest{ContainerID: party2.ContainerID, FleetName: fleet1Name}))
+	exists, err = client.Do(ctx, client.B().Exists().Key(redisKeyAffinity(frontend.(*redisFrontend).keyPrefix, fleet1Name, "party2")).Build()).AsInt64()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), exists)
+}
+
+func TestAllocationWithAntiAffinity(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	for _, c := range []struct{ id, host string }{{"con1", "host1"}, {"con2", "host1"}, {"con3", "host2"}} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: c.id, InitialCapacity: 5, FleetName: fleet1Name, Labels: map[string]string{"host": c.host}})
+		require.NoError(t, err)
+	}
+
+	// per container
+	containers := map[string]struct{}{}
+	for i := range 3 {
+		room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("replica%d", i), FleetName: fleet1Name, AntiAffinityGroup: "shard1"})
+		require.NoError(t, err)
+		containers[room.ContainerID] = struct{}{}
+	}
+	require.Len(t, containers, 3)
+	_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "replica3", FleetName: fleet1Name, AntiAffinityGroup: "shard1"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+
+	// AllocateRooms tells the same, and also when the rooms of a group are placed on the same container
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: []arena.AllocateRoomRequest{
+		{RoomID: "room0", FleetName: fleet1Name},
+		{RoomID: "replica3", FleetName: fleet1Name, AntiAffinityGroup: "shard1"},
+	}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Placement: arena.RoomPlacementSameContainer, Rooms: []arena.AllocateRoomRequest{
+		{RoomID: "room0", FleetName: fleet1Name, AntiAffinityGroup: "shard0"},
+		{RoomID: "replica3", FleetName: fleet1Name, AntiAffinityGroup: "shard0"},
+	}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+
+	// per host
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, AntiAffinityGroup: "shard2", AntiAffinityTopologyKey: "host"})
+	require.NoError(t, err)
+	room2, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, AntiAffinityGroup: "shard2", AntiAffinityTopologyKey: "host"})
+	require.NoError(t, err)
+	require.True(t, (room1.ContainerID == "con3") != (room2.ContainerID == "con3"))
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name, AntiAffinityGroup: "shard2", AntiAffinityTopologyKey: "host"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+
+	// releasing a room of the group makes room for another
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: room1.ContainerID, FleetName: fleet1Name, RoomID: "room1"}))
+	room3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name, AntiAffinityGroup: "shard2", AntiAffinityTopologyKey: "host"})
+	require.NoError(t, err)
+	require.NotEqual(t, room2.ContainerID, room3.ContainerID)
+
+	// re-adding a container (e.g. after a restart) removes its rooms from the groups
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con3", InitialCapacity: 5, FleetName: fleet1Name, Labels: map[string]string{"host": "host2"}})
+	require.NoError(t, err)
+	replica3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "replica3", FleetName: fleet1Name, AntiAffinityGroup: "shard1"})
+	require.NoError(t, err)
+	require.Equal(t, "con3", replica3.ContainerID)
+
+	// per host of the container topology
+	fleet2Name := "fleet2"
+	hostOf := map[string]string{"con4": "host3", "con5": "host3", "con6": "host4"}
+	for containerID, host := range hostOf {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: containerID, InitialCapacity: 5, FleetName: fleet2Name, Topology: arena.ContainerTopology{Host: host}})
+		require.NoError(t, err)
+	}
+	hosts := map[string]struct{}{}
+	for i := range 2 {
+		room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("replica%d", i), FleetName: fleet2Name, AntiAffinityGroup: "shard3", AntiAffinityTopologyKey: arena.TopologyKeyHost})
+		require.NoError(t, err)
+		hosts[hostOf[room.ContainerID]] = struct{}{}
+	}
+	require.Len(t, hosts, 2)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "replica2", FleetName: fleet2Name, AntiAffinityGroup: "shard3", AntiAffinityTopologyKey: arena.TopologyKeyHost})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+}
+
+func TestAllocationWithPreferredZones(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	for _, c := range []struct {
+		id       string
+		zone     string
+		capacity int
+	}{{"con-a", "zone-a", 1}, {"con-b", "zone-b", 2}, {"con-c", "zone-c", 1}} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: c.id, InitialCapacity: c.capacity, FleetName: fleet1Name,
+			Topology: arena.ContainerTopology{Region: "region1", Zone: c.zone, Host: c.id}})
+		require.NoError(t, err)
+	}
+
+	// zone-b is filled first, then zone-a, then any zone
+	for i, zone := range []string{"zone-b", "zone-b", "zone-a", "zone-c"} {
+		room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("room%d", i), FleetName: fleet1Name, PreferredZones: []string{"zone-b", "zone-a"}})
+		require.NoError(t, err)
+		require.Equal(t, zone, room.Zone)
+	}
+	_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name, PreferredZones: []string{"zone-b", "zone-a"}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// the preferred zone wins even if its container is on a later page of candidates
+	fleet2Name := "fleet2"
+	for _, c := range []struct {
+		id       string
+		zone     string
+		capacity int
+	}{{"con-c2", "zone-c", 1}, {"con-a2", "zone-a", 2}} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: c.id, InitialCapacity: c.capacity, FleetName: fleet2Name,
+			Topology: arena.ContainerTopology{Region: "region1", Zone: c.zone, Host: c.id}})
+		require.NoError(t, err)
+	}
+	pagedFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client, WithCandidateContainerMaxCount(1))
+	room, err := pagedFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room5", FleetName: fleet2Name, PreferredZones: []string{"zone-a"}})
+	require.NoError(t, err)
+	require.Equal(t, "con-a2", room.ContainerID)
+}
+
+func TestAllocationWithPlayerLatencies(t *testing.T) {
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	// a container without region is regarded to be in the region named after its fleet
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-asia", InitialCapacity: 1, FleetName: "asia"})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-us", InitialCapacity: 1, FleetName: "us",
+		Topology: arena.ContainerTopology{Region: "us-west", Zone: "us-west-1a"}})
+	require.NoError(t, err)
+
+	latencies := []map[string]time.Duration{
+		{"asia": 30 * time.Millisecond, "us-west": 100 * time.Millisecond, "eu": 10 * time.Millisecond},
+		{"asia": 150 * time.Millisecond, "us-west": 90 * time.Millisecond},
+	}
+	req := arena.AllocateRoomRequest{FleetName: "asia", FallbackFleetNames: []string{"us"}, PlayerLatencies: latencies}
+
+	// max: asia=150ms, us-west=100ms
+	req.RoomID = "room1"
+	room1, err := frontend.AllocateRoom(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "con-us", room1.ContainerID)
+	require.Equal(t, "us-west", room1.Region)
+	require.Equal(t, "us-west-1a", room1.Zone)
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con-us", FleetName: "us", RoomID: "room1"}))
+
+	// average: asia=90ms, us-west=95ms
+	req.RoomID = "room2"
+	req.LatencyObjective = arena.LatencyObjectiveAverage
+	room2, err := frontend.AllocateRoom(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "con-asia", room2.ContainerID)
+	require.Equal(t, "asia", room2.Region)
+
+	// asia is full, so the next region is chosen
+	req.RoomID = "room3"
+	room3, err := frontend.AllocateRoom(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "us-west", room3.Region)
+
+	// no region is measured by every player
+	req.RoomID = "room4"
+	req.PlayerLatencies = []map[string]time.Duration{{"asia": time.Millisecond}, {"eu": time.Millisecond}}
+	_, err = frontend.AllocateRoom(ctx, req)
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+}
+
+func TestAllocationWithTopCandidates(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithTopCandidates(2, CandidateWeightingUniform))
+
+	for _, id := range []string{"con1", "con2", "con3"} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: id, InitialCapacity: 100, FleetName: fleet1Name})
+		require.NoError(t, err)
+	}
+	// make con3 the last candidate of the packed strategy
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con3", InitialCapacity: 1000, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// the packed strategy alone would allocate all the rooms to con1
+	counts := map[string]int{}
+	for i := range 20 {
+		room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("room%d", i), FleetName: fleet1Name})
+		require.NoError(t, err)
+		counts[room.ContainerID]++
+	}
+	require.Positive(t, counts["con1"])
+	require.Positive(t, counts["con2"])
+	require.Zero(t, counts["con3"])
+}
+
+func TestAllocationWithContainerSelector(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	var backend arena.Backend
+	calls := 0
+	// prefer the container in the zone with the least rooms
+	selector := ContainerSelectorFunc(func(ctx context.Context, req arena.AllocateRoomRequest, candidates []ContainerCandidate) []ContainerCandidate {
+		calls++
+		if calls == 1 {
+			// another allocation changes the containers between the snapshot and the commit
+			_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 9, FleetName: fleet1Name, Labels: map[string]string{"tier": "gold"}})
+			require.NoError(t, err)
+		}
+		var selected []ContainerCandidate
+		for _, c := range candidates {
+			if c.Labels["tier"] == "gold" {
+				selected = append(selected, c)
+			}
+		}
+		return selected
+	})
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithContainerSelector(selector))
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name, Labels: map[string]string{"tier": "silver"}})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 10, FleetName: fleet1Name, Labels: map[string]string{"tier": "gold"}})
+	require.NoError(t, err)
+
+	// the packed strategy would choose con1
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room1.ContainerID)
+	require.Equal(t, 2, calls)
+
+	// containers that are not selected are never chosen
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"tier": "silver"}}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// without a candidate, the room is allocated as without the selector
+	gold := arena.LabelSelector{MatchLabels: map[string]string{"tier": "gold"}}
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "replica1", FleetName: fleet1Name, LabelSelector: gold, AntiAffinityGroup: "shard1"})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "replica2", FleetName: fleet1Name, LabelSelector: gold, AntiAffinityGroup: "shard1"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusUnsatisfiable))
+	plainFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client)
+	_, err = plainFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch", FleetName: fleet1Name, LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"tier": "silver"}}})
+	require.NoError(t, err)
+	vip, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip", FleetName: fleet1Name, Priority: 10, LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"tier": "silver"}}})
+	require.NoError(t, err)
+	require.Equal(t, "con1", vip.ContainerID)
+	require.Equal(t, "batch", vip.PreemptedRoomID)
+}
+
+func TestAllocationWithContainerSelectorBeyondCandidateWindow(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	var snapshots [][]ContainerCandidate
+	selector := ContainerSelectorFunc(func(ctx context.Context, req arena.AllocateRoomRequest, candidates []ContainerCandidate) []ContainerCandidate {
+		snapshots = append(snapshots, candidates)
+		return candidates
+	})
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithContainerSelector(selector), WithCandidateContainerMaxCount(2))
+
+	// only the containers at the end of the index match, one of them in another region
+	for _, containerID := range []string{"con1", "con2", "con3", "con4"} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: containerID, InitialCapacity: 1, FleetName: fleet1Name,
+			Topology: arena.ContainerTopology{Region: "region1"}})
+		require.NoError(t, err)
+	}
+	for containerID, region := range map[string]string{"con5": "region1", "con6": "region2"} {
+		_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: containerID, InitialCapacity: 1, FleetName: fleet1Name,
+			Labels: map[string]string{"gpu": "true"}, Topology: arena.ContainerTopology{Region: region}})
+		require.NoError(t, err)
+	}
+
+	// the snapshot reads the candidates page by page, in the regions to search
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name,
+		LabelSelector:   arena.LabelSelector{MatchLabels: map[string]string{"gpu": "true"}},
+		PlayerLatencies: []map[string]time.Duration{{"region1": 10 * time.Millisecond}}})
+	require.NoError(t, err)
+	require.Equal(t, "con5", room1.ContainerID)
+	require.Len(t, snapshots, 1)
+	require.Len(t, snapshots[0], 1)
+	require.Equal(t, "con5", snapshots[0][0].ContainerID)
+}
+
+func TestExplainAllocation(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-full", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room0", FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-dead", InitialCapacity: 1, FleetName: fleet1Name, HeartbeatTTL: 1 * time.Second})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-small", InitialCapacity: 2, FleetName: fleet1Name, Labels: map[string]string{"map": "desert"}})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-forest", InitialCapacity: 3, FleetName: fleet1Name, Labels: map[string]string{"map": "forest"}})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-desert", InitialCapacity: 4, FleetName: fleet1Name, Labels: map[string]string{"map": "desert"},
+		Resources: map[string]int{"gpu": 1}})
+	require.NoError(t, err)
+	time.Sleep(1500 * time.Millisecond)
+
+	req := arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, Resources: map[string]int{"gpu": 1},
+		LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"map": "desert"}}}
+	explained, err := frontend.ExplainAllocation(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "con-desert", explained.ContainerID)
+	require.Equal(t, fleet1Name, explained.FleetName)
+	require.False(t, explained.AlreadyAllocated)
+	require.ElementsMatch(t, []arena.CandidateRejection{
+		{ContainerID: "con-full", FleetName: fleet1Name, Reason: arena.RejectionReasonNoCapacity},
+		{ContainerID: "con-dead", FleetName: fleet1Name, Reason: arena.RejectionReasonHeartbeatMissing},
+		{ContainerID: "con-small", FleetName: fleet1Name, Reason: arena.RejectionReasonInsufficientResources},
+		{ContainerID: "con-forest", FleetName: fleet1Name, Reason: arena.RejectionReasonLabelMismatch},
+	}, explained.Rejections)
+
+	// nothing has changed, e.g. the dead container has not been removed
+	again, err := frontend.ExplainAllocation(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, explained, again)
+	room1, err := frontend.AllocateRoom(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, explained.ContainerID, room1.ContainerID)
+
+	explained, err = frontend.ExplainAllocation(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, "con-desert", explained.ContainerID)
+	require.True(t, explained.AlreadyAllocated)
+	explained, err = frontend.ExplainAllocation(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name, Resources: map[string]int{"gpu": 1}})
+	require.NoError(t, err)
+	require.Empty(t, explained.ContainerID)
+}
+
+func TestExplainAllocationWithReapingAndPreemption(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// an expired reservation is regarded as released, as AllocateRoom releases it first
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "reserved", FleetName: fleet1Name}, TTL: 200 * time.Millisecond})
+	require.NoError(t, err)
+	explained, err := frontend.ExplainAllocation(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Empty(t, explained.ContainerID)
+	time.Sleep(500 * time.Millisecond)
+	explained, err = frontend.ExplainAllocation(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", explained.ContainerID)
+	require.Empty(t, explained.Rejections)
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+
+	// a room of lower priority would be preempted
+	explained, err = frontend.ExplainAllocation(ctx, arena.AllocateRoomRequest{RoomID: "vip", FleetName: fleet1Name, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "con1", explained.ContainerID)
+	require.Equal(t, "room1", explained.PreemptedRoomID)
+	explained, err = frontend.ExplainAllocation(ctx, arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Empty(t, explained.ContainerID)
+	require.Empty(t, explained.PreemptedRoomID)
+	vip, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip", FleetName: fleet1Name, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "room1", vip.PreemptedRoomID)
+}
+
+func TestAllocationExclusive(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+
+	// only the empty container is selected, and it takes the whole capacity
+	premium, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "premium", FleetName: fleet1Name, Exclusive: true})
+	require.NoError(t, err)
+	require.Equal(t, "con2", premium.ContainerID)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "premium2", FleetName: fleet1Name, Exclusive: true})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	for i := range 2 {
+		room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: fmt.Sprintf("room%d", i+2), FleetName: fleet1Name})
+		require.NoError(t, err)
+		require.Equal(t, "con1", room.ContainerID)
+	}
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room4", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// releasing the exclusive room returns the whole capacity
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: "premium"}))
+	containers, err := metrics.GetContainers(ctx, fleet1Name)
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	require.Equal(t, "con2", containers[0].ContainerID)
+	require.Equal(t, 3, containers[0].Capacity)
+}
+
+func TestAllocationWithPriority(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithPreemptionGracePeriod(10*time.Second))
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "match", FleetName: fleet1Name, Priority: 5})
+	require.NoError(t, err)
+	require.Equal(t, "match", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+	batch, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Empty(t, batch.PreemptedRoomID)
+	require.Equal(t, "batch", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+
+	// the room of the lowest priority is preempted
+	vip, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip", FleetName: fleet1Name, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "con1", vip.ContainerID)
+	require.Equal(t, "batch", vip.PreemptedRoomID)
+	preempted := mustReadChan(t, con1.EventChannel).(*arena.RoomPreemptedEvent)
+	require.Equal(t, "batch", preempted.RoomID)
+	require.Equal(t, 10*time.Second, preempted.GracePeriod)
+
+	// the preempted room keeps its slot until it is released
+	room, err := frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "vip", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, arena.RoomStatePending, room.State)
+	require.Empty(t, con1.EventChannel)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip-other", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "batch"}))
+	require.Equal(t, "vip", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+	room, err = frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "vip", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, arena.RoomStateAllocated, room.State)
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "batch", FleetName: fleet1Name, Body: []byte("hello")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// a room of the same or lower priority is not preempted
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "match2", FleetName: fleet1Name, Priority: 5})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// a released room is no longer preempted
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "match"}))
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch2", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "batch2", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+
+	// the preempted room is released when the grace period has passed
+	shortGraceFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client, WithPreemptionGracePeriod(100*time.Millisecond))
+	vip2, err := shortGraceFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip2", FleetName: fleet1Name, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "batch2", vip2.PreemptedRoomID)
+	require.Equal(t, "batch2", mustReadChan(t, con1.EventChannel).(*arena.RoomPreemptedEvent).RoomID)
+	require.Equal(t, "vip2", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+	_, err = frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "batch2", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// the pending room is released if the container has lost its subscription by the time it takes over the slot
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "vip2"}))
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch3", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "batch3", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+	vip3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip3", FleetName: fleet1Name, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "batch3", vip3.PreemptedRoomID)
+	require.Equal(t, "batch3", mustReadChan(t, con1.EventChannel).(*arena.RoomPreemptedEvent).RoomID)
+	unsubscribeContainer(t, frontend, backend, fleet1Name, "con1")
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "batch3"}))
+	_, err = frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "vip3", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// the rooms are scanned page by page past those on the containers that cannot host the room
+	fleet2Name := "fleet2"
+	pagedFrontend := NewFrontend(frontend.(*redisFrontend).keyPrefix, frontend.(*redisFrontend).client, WithCandidateContainerMaxCount(1))
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-std", InitialCapacity: 2, FleetName: fleet2Name, Labels: map[string]string{"tier": "std"}})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con-gpu", InitialCapacity: 1, FleetName: fleet2Name, Labels: map[string]string{"tier": "gpu"}})
+	require.NoError(t, err)
+	gpuSelector := arena.LabelSelector{MatchLabels: map[string]string{"tier": "gpu"}}
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch-a1", FleetName: fleet2Name, LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"tier": "std"}}})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch-a2", FleetName: fleet2Name, LabelSelector: arena.LabelSelector{MatchLabels: map[string]string{"tier": "std"}}})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "batch-b1", FleetName: fleet2Name, LabelSelector: gpuSelector})
+	require.NoError(t, err)
+	vip4, err := pagedFrontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "vip4", FleetName: fleet2Name, LabelSelector: gpuSelector, Priority: 10})
+	require.NoError(t, err)
+	require.Equal(t, "con-gpu", vip4.ContainerID)
+	require.Equal(t, "batch-b1", vip4.PreemptedRoomID)
+}
+
+func TestAllocationWithPreferredContainer(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 1, FleetName: fleet1Name})
+	require.NoError(t, err)
+
+	// without preference, the packed strategy selects con2
+	rematch, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "rematch1", FleetName: fleet1Name, PreferredContainerID: "con1"})
+	require.NoError(t, err)
+	require.Equal(t, "con1", rematch.ContainerID)
+	require.True(t, rematch.PreferredContainerHonored)
+
+	// an unknown container is ignored
+	room, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, PreferredContainerID: "con3"})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room.ContainerID)
+	require.False(t, room.PreferredContainerHonored)
+
+	// a full container is ignored
+	rematch, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "rematch2", FleetName: fleet1Name, PreferredContainerID: "con1"})
+	require.NoError(t, err)
+	require.Equal(t, "con2", rematch.ContainerID)
+	require.False(t, rematch.PreferredContainerHonored)
+}
+
+func TestGlobalRoomRegistry(t *testing.T) {
+	fleet1Name := "fleet1"
+	fleet2Name := "fleet2"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t, WithGlobalRoomRegistry())
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+	con2, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 2, FleetName: fleet2Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "room1", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+
+	// the room ID is unique across the fleets
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet2Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+	_, err = frontend.AllocateRooms(ctx, arena.AllocateRoomsRequest{Rooms: []arena.AllocateRoomRequest{{RoomID: "room1", FleetName: fleet2Name}}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+
+	// the room is found without the fleet
+	require.NoError(t, frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room1", Body: []byte("hello")}))
+	require.Equal(t, "hello", string(mustReadChan(t, con1.EventChannel).(*arena.NotifyToRoomEvent).Body))
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room2", Body: []byte("hello")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet2Name}})
+	require.NoError(t, err)
+	require.NoError(t, frontend.CommitReservation(ctx, arena.CommitReservationRequest{RoomID: "room2"}))
+	require.Equal(t, "room2", mustReadChan(t, con2.EventChannel).(*arena.AllocationEvent).RoomID)
+
+	// the room ID can be used in another fleet once released
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room1", Body: []byte("hello")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	room1, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet2Name})
+	require.NoError(t, err)
+	require.Equal(t, "con2", room1.ContainerID)
+}
+
+func TestDeallocateRoom(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	con1, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "room1", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name}})
+	require.NoError(t, err)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
+
+	// the container is told to tear the room down
+	require.NoError(t, frontend.DeallocateRoom(ctx, arena.DeallocateRoomRequest{RoomID: "room1", FleetName: fleet1Name}))
+	ev := mustReadChan(t, con1.EventChannel).(*arena.RoomDeallocatedEvent)
+	require.Equal(t, "room1", ev.RoomID)
+	err = frontend.DeallocateRoom(ctx, arena.DeallocateRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room1", FleetName: fleet1Name, Body: []byte("hello")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// a reservation is released silently
+	require.NoError(t, frontend.DeallocateRoom(ctx, arena.DeallocateRoomRequest{RoomID: "room2", FleetName: fleet1Name}))
+	containers, err := metrics.GetContainers(ctx, fleet1Name)
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	require.Equal(t, 2, containers[0].Capacity)
+	room3, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room3", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room3.ContainerID)
+	require.Equal(t, "room3", mustReadChan(t, con1.EventChannel).(*arena.AllocationEvent).RoomID)
+}
+
+func TestGetRoom(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 2, FleetName: fleet1Name, HeartbeatTTL: 1 * time.Second})
+	require.NoError(t, err)
+	before := time.Now().Truncate(time.Millisecond)
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room1", FleetName: fleet1Name, RoomInitialData: []byte("initial")})
+	require.NoError(t, err)
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room2", FleetName: fleet1Name}})
+	require.NoError(t, err)
+
+	room1, err := frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, "con1", room1.ContainerID)
+	require.Equal(t, fleet1Name, room1.FleetName)
+	require.Equal(t, arena.RoomStateAllocated, room1.State)
+	require.Equal(t, "initial", string(room1.RoomInitialData))
+	require.False(t, room1.AllocatedAt.Before(before))
+	require.GreaterOrEqual(t, room1.Age, time.Duration(0))
+	require.True(t, room1.ContainerAlive)
+	room2, err := frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "room2", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.Equal(t, arena.RoomStateReserved, room2.State)
+	require.Empty(t, room2.RoomInitialData)
+
+	// the room outlives its container until it is released
+	time.Sleep(1500 * time.Millisecond)
+	room1, err = frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: "room1", FleetName: fleet1Name})
+	require.NoError(t, err)
+	require.False(t, room1.ContainerAlive)
+	require.GreaterOrEqual(t, room1.Age, time.Second)
+}
+
+func TestListRooms(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, metrics := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con2", InitialCapacity: 3, FleetName: fleet1Name})
+	require.NoError(t, err)
+	var allocatedAt []time.Time
+	for i := range 5 {
+		roomID := fmt.Sprintf("room%d", i+1)
+		_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name, Strategy: arena.AllocationStrategyDistributed})
+		require.NoError(t, err)
+		room, err := frontend.GetRoom(ctx, arena.GetRoomRequest{RoomID: roomID, FleetName: fleet1Name})
+		require.NoError(t, err)
+		allocatedAt = append(allocatedAt, room.AllocatedAt)
+		if i == 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	listAll := func(req ListRoomsRequest) []RoomSummary {
+		t.Helper()
+		var rooms []RoomSummary
+		for {
+			resp, err := metrics.ListRooms(ctx, req)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(resp.Rooms), req.Limit)
+			rooms = append(rooms, resp.Rooms...)
+			if resp.NextCursor == "" {
+				return rooms
+			}
+			req.Cursor = resp.NextCursor
+		}
+	}
+	roomIDs := func(rooms []RoomSummary) []string {
+		var ids []string
+		for _, room := range rooms {
+			ids = append(ids, room.RoomID)
+		}
+		return ids
+	}
+
+	// oldest first, across the pages
+	rooms := listAll(ListRoomsRequest{FleetName: fleet1Name, Limit: 2})
+	require.Equal(t, []string{"room1", "room2", "room3", "room4", "room5"}, roomIDs(rooms))
+	for i, room := range rooms {
+		require.Equal(t, arena.RoomStateAllocated, room.State)
+		require.Equal(t, allocatedAt[i], room.AllocatedAt)
+	}
+
+	// rooms released while paging are not listed
+	resp, err := metrics.ListRooms(ctx, ListRoomsRequest{FleetName: fleet1Name, Limit: 2})
+	require.NoError(t, err)
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: rooms[2].ContainerID, FleetName: fleet1Name, RoomID: "room3"}))
+	resp, err = metrics.ListRooms(ctx, ListRoomsRequest{FleetName: fleet1Name, Limit: 2, Cursor: resp.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, []string{"room4", "room5"}, roomIDs(resp.Rooms))
+
+	// filter by allocation time
+	rooms = listAll(ListRoomsRequest{FleetName: fleet1Name, Limit: 2, AllocatedAfter: allocatedAt[3]})
+	require.Equal(t, []string{"room4", "room5"}, roomIDs(rooms))
+	rooms = listAll(ListRoomsRequest{FleetName: fleet1Name, Limit: 2, AllocatedBefore: allocatedAt[3]})
+	require.Equal(t, []string{"room1", "room2"}, roomIDs(rooms))
+
+	// filter by container
+	rooms = listAll(ListRoomsRequest{FleetName: fleet1Name, Limit: 2, ContainerID: "con1"})
+	for _, room := range rooms {
+		require.Equal(t, "con1", room.ContainerID)
+	}
+	con2Rooms := listAll(ListRoomsRequest{FleetName: fleet1Name, Limit: 2, ContainerID: "con2"})
+	require.ElementsMatch(t, []string{"room1", "room2", "room4", "room5"}, append(roomIDs(rooms), roomIDs(con2Rooms)...))
+
+	// rooms allocated at the same time are ordered by room ID, even if a page ends in the middle of a batch
+	fleet2Name := "fleet2"
+	_, err = backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con3", InitialCapacity: 7, FleetName: fleet2Name})
+	require.NoError(t, err)
+	client := frontend.(*redisFrontend).client
+	allocationTimesKey := redisKeyRoomAllocationTimes(frontend.(*redisFrontend).keyPrefix, fleet2Name)
+	var fleet2RoomIDs []string
+	for i := range 7 {
+		roomID := fmt.Sprintf("room%d", i+1)
+		_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet2Name})
+		require.NoError(t, err)
+		allocatedAtMs := 1000
+		if i >= 2 {
+			allocatedAtMs = 2000
+		}
+		require.NoError(t, client.Do(ctx, client.B().Zadd().Key(allocationTimesKey).Xx().ScoreMember().ScoreMember(float64(allocatedAtMs), roomID).Build()).Error())
+		fleet2RoomIDs = append(fleet2RoomIDs, roomID)
+	}
+	rooms = listAll(ListRoomsRequest{FleetName: fleet2Name, Limit: 3})
+	require.Equal(t, fleet2RoomIDs, roomIDs(rooms))
+
+	_, err = metrics.ListRooms(ctx, ListRoomsRequest{FleetName: fleet1Name, Cursor: "invalid"})
+	require.Error(t, err)
+}
+
+func TestSearchRooms(t *testing.T) {
+	fleet1Name := "fleet1"
+	ctx := t.Context()
+	frontend, backend, _ := newFrontendBackendMetrics(t)
+
+	_, err := backend.AddContainer(ctx, arena.AddContainerRequest{ContainerID: "con1", InitialCapacity: 7, FleetName: fleet1Name})
+	require.NoError(t, err)
+	rooms := map[string]map[string]string{
+		"room1": {"map": "desert", "mode": "ctf", "open_slots": "3"},
+		"room2": {"map": "desert", "mode": "dm", "open_slots": "10"},
+		"room3": {"map": "forest", "mode": "ctf", "open_slots": "1", "password": "true"},
+		"room4": nil,
+	}
+	for roomID, properties := range rooms {
+		_, err := frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name, Properties: properties})
+		require.NoError(t, err)
+	}
+	_, err = frontend.ReserveRoom(ctx, arena.ReserveRoomRequest{AllocateRoomRequest: arena.AllocateRoomRequest{RoomID: "room5", FleetName: fleet1Name, Properties: map[string]string{"map": "desert"}}})
+	require.NoError(t, err)
+
+	search := func(req arena.SearchRoomsRequest) []string {
+		t.Helper()
+		req.FleetName = fleet1Name
+		resp, err := frontend.SearchRooms(ctx, req)
+		require.NoError(t, err)
+		var roomIDs []string
+		for _, room := range resp.Rooms {
+			require.Equal(t, "con1", room.ContainerID)
+			require.Equal(t, rooms[room.RoomID], room.Properties)
+			roomIDs = append(roomIDs, room.RoomID)
+		}
+		return roomIDs
+	}
+
+	// only the allocated rooms with properties are searched
+	require.Equal(t, []string{"room1", "room2", "room3"}, search(arena.SearchRoomsRequest{}))
+	require.Equal(t, []string{"room1", "room2"}, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "map", Operator: arena.RoomPropertyOpEqual, Value: "desert"},
+	}}))
+	require.Equal(t, []string{"room1", "room2"}, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "password", Operator: arena.RoomPropertyOpNotEqual, Value: "true"},
+	}}))
+	require.Equal(t, []string{"room2", "room1"}, search(arena.SearchRoomsRequest{
+		Filters: []arena.RoomPropertyFilter{{Key: "open_slots", Operator: arena.RoomPropertyOpGreaterThanOrEqual, Value: "2"}},
+		SortBy:  "open_slots", Descending: true,
+	}))
+	require.Equal(t, []string{"room3", "room1"}, search(arena.SearchRoomsRequest{SortBy: "open_slots", Limit: 2}))
+
+	// the container updates the properties
+	rooms["room2"] = map[string]string{"map": "desert", "mode": "dm", "open_slots": "0"}
+	require.NoError(t, backend.SetRoomProperties(ctx, arena.SetRoomPropertiesRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room2", Properties: map[string]string{"open_slots": "0"}}))
+	rooms["room3"] = map[string]string{"map": "forest", "mode": "ctf", "open_slots": "1"}
+	require.NoError(t, backend.SetRoomProperties(ctx, arena.SetRoomPropertiesRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room3", Properties: map[string]string{"password": ""}}))
+	require.Equal(t, []string{"room1", "room3"}, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "open_slots", Operator: arena.RoomPropertyOpGreaterThan, Value: "0"},
+	}}))
+	err = backend.SetRoomProperties(ctx, arena.SetRoomPropertiesRequest{ContainerID: "con2", FleetName: fleet1Name, RoomID: "room1", Properties: map[string]string{"open_slots": "0"}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+
+	// released rooms are not searched
+	require.NoError(t, backend.ReleaseRoom(ctx, arena.ReleaseRoomRequest{ContainerID: "con1", FleetName: fleet1Name, RoomID: "room1"}))
+	require.Equal(t, []string{"room2", "room3"}, search(arena.SearchRoomsRequest{}))
+
+	// the '=' filters use the index of the property values
+	rooms["room6"] = map[string]string{"map": "desert"}
+	_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: "room6", FleetName: fleet1Name, Properties: rooms["room6"]})
+	require.NoError(t, err)
+	require.Equal(t, []string{"room2", "room6"}, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "map", Operator: arena.RoomPropertyOpEqual, Value: "desert"},
+	}}))
+	require.Empty(t, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "password", Operator: arena.RoomPropertyOpEqual, Value: "true"},
+	}}))
+	require.Equal(t, []string{"room3"}, search(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "map", Operator: arena.RoomPropertyOpNotEqual, Value: "desert"},
+		{Key: "mode", Operator: arena.RoomPropertyOpEqual, Value: "ctf"},
+	}}))
+
+	// the rooms are paged in order
+	searchPages := func(req arena.SearchRoomsRequest) []string {
+		t.Helper()
+		req.FleetName = fleet1Name
+		req.Limit = 1
+		var roomIDs []string
+		for {
+			resp, err := frontend.SearchRooms(ctx, req)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(resp.Rooms), 1)
+			for _, room := range resp.Rooms {
+				roomIDs = append(roomIDs, room.RoomID)
+			}
+			if resp.NextCursor == "" {
+				return roomIDs
+			}
+			req.Cursor = resp.NextCursor
+		}
+	}
+	require.Equal(t, []string{"room2", "room3", "room6"}, searchPages(arena.SearchRoomsRequest{SortBy: "open_slots"}))
+	require.Equal(t, []string{"room2", "room3", "room6"}, searchPages(arena.SearchRoomsRequest{}))
+
+	// the rooms without a numeric SortBy property come last in order of room ID
+	rooms["room7"] = map[string]string{"map": "forest", "open_slots": "many"}
+	rooms["room8"] = map[string]string{"map": "forest", "open_slots": "1.0"}
+	for _, roomID := range []string{"room7", "room8"} {
+		_, err = frontend.AllocateRoom(ctx, arena.AllocateRoomRequest{RoomID: roomID, FleetName: fleet1Name, Properties: rooms[roomID]})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"room8", "room3", "room2", "room6", "room7"}, searchPages(arena.SearchRoomsRequest{SortBy: "open_slots", Descending: true}))
+	require.Equal(t, []string{"room3", "room8", "room7"}, searchPages(arena.SearchRoomsRequest{SortBy: "open_slots", Filters: []arena.RoomPropertyFilter{
+		{Key: "map", Operator: arena.RoomPropertyOpEqual, Value: "forest"},
+	}}))
+	require.Equal(t, []string{"room3", "room8"}, searchPages(arena.SearchRoomsRequest{SortBy: "open_slots", Filters: []arena.RoomPropertyFilter{
+		{Key: "open_slots", Operator: arena.RoomPropertyOpGreaterThan, Value: "0"},
+		{Key: "open_slots", Operator: arena.RoomPropertyOpLessThanOrEqual, Value: "1"},
+	}}))
+	require.Equal(t, []string{"room2", "room8"}, searchPages(arena.SearchRoomsRequest{Filters: []arena.RoomPropertyFilter{
+		{Key: "open_slots", Operator: arena.RoomPropertyOpLessThan, Value: "1.5"},
+		{Key: "mode", Operator: arena.RoomPropertyOpNotEqual, Value: "ctf"},
+	}}))
+	_, err = frontend.SearchRooms(ctx, arena.SearchRoomsRequest{FleetName: fleet1Name, Cursor: "invalid"})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+
+	_, err = frontend.SearchRooms(ctx, arena.SearchRoomsRequest{FleetName: fleet1Name, Filters: []arena.RoomPropertyFilter{
+		{Key: "open_slots", Operator: arena.RoomPropertyOpGreaterThan, Value: "many"},
+	}})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
+}
+
 func TestNotifyToRoom(t *testing.T) {
 	fleet1Name := "fleet1"
 	ctx := t.Context()
@@ -125,6 +1578,12 @@ func TestNotifyToRoom(t *testing.T) {
 	require.NoError(t, err)
 	ev2 := mustReadChan(t, con1.EventChannel).(*arena.NotifyToRoomEvent)
 	require.Equal(t, "hello_room1", string(ev2.Body))
+
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room2", FleetName: fleet1Name, Body: []byte("hello_room2")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusNotFound))
+	// the fleet is required without the global room registry
+	err = frontend.NotifyToRoom(ctx, arena.NotifyToRoomRequest{RoomID: "room1", Body: []byte("hello_room1")})
+	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusInvalidRequest))
 }
 
 func TestHeartbeat(t *testing.T) {
@@ -166,7 +1625,7 @@ func TestHeartbeat(t *testing.T) {
 	require.True(t, arena.ErrorHasStatus(err, arena.ErrorStatusResourceExhausted))
 }
 
-func newFrontendBackendMetrics(t *testing.T) (arena.Frontend, arena.Backend, *Metrics) {
+func newFrontendBackendMetrics(t *testing.T, opts ...RedisFrontendOption) (arena.Frontend, arena.Backend, *Metrics) {
 	t.Helper()
 	frontendClient, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{localRedisAddr}, DisableCache: true})
 	if err != nil {
@@ -174,7 +1633,7 @@ func newFrontendBackendMetrics(t *testing.T) (arena.Frontend, arena.Backend, *Me
 	}
 	checkRedisConnection(t, frontendClient)
 	keyPrefix := fmt.Sprintf("arenaredis_test_%s", uuid.New().String())
-	frontend := NewFrontend(keyPrefix, frontendClient)
+	frontend := NewFrontend(keyPrefix, frontendClient, opts...)
 	backendClient, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{localRedisAddr}, DisableCache: true})
 	if err != nil {
 		t.Fatalf("failed to create pub/sub redis frontendClient: %+v", err)
@@ -190,6 +1649,19 @@ func newFrontendBackendMetrics(t *testing.T) (arena.Frontend, arena.Backend, *Me
 	return frontend, backend, metrics
 }
 
+// unsubscribeContainer makes a container lose its subscription while keeping its heartbeat
+// (e.g. the backend instance holding it died) and waits until nobody is subscribed to its events.
+func unsubscribeContainer(t *testing.T, frontend arena.Frontend, backend arena.Backend, fleetName, containerID string) {
+	t.Helper()
+	backend.(*redisBackend).getOrCreateFleet(fleetName).containers[containerID].stop()
+	client := frontend.(*redisFrontend).client
+	channel := redisPubSubChannelContainer(frontend.(*redisFrontend).keyPrefix, fleetName, containerID)
+	require.Eventually(t, func() bool {
+		numsub, err := client.Do(t.Context(), client.B().PubsubNumsub().Channel(channel).Build()).AsIntMap()
+		return err == nil && numsub[channel] == 0
+	}, chanReadTimeout, 10*time.Millisecond)
+}
+
 func checkRedisConnection(t *testing.T, c rueidis.Client) {
 	t.Helper()
 	if err := c.Do(t.Context(), c.B().Ping().Build()).Error(); err != nil {
@@ -197,6 +1669,30 @@ func checkRedisConnection(t *testing.T, c rueidis.Client) {
 	}
 }
 
+type allocationResult struct {
+	resp *arena.AllocateRoomResponse
+	err  error
+}
+
+// allocateRoomAsync calls AllocateRoom in the background (e.g. to wait for capacity) and returns the channel of the result.
+func allocateRoomAsync(ctx context.Context, frontend arena.Frontend, req arena.AllocateRoomRequest) <-chan allocationResult {
+	ch := make(chan allocationResult, 1)
+	go func() {
+		resp, err := frontend.AllocateRoom(ctx, req)
+		ch <- allocationResult{resp: resp, err: err}
+	}()
+	return ch
+}
+
+// requireAllocationQueueLength waits until the number of requests waiting for capacity in the fleet becomes expected.
+func requireAllocationQueueLength(t *testing.T, metrics *Metrics, fleetName string, expected int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		n, err := metrics.GetAllocationQueueLength(t.Context(), fleetName)
+		return err == nil && n == expected
+	}, chanReadTimeout, 10*time.Millisecond)
+}
+
 func mustReadChan[T any](t *testing.T, ch <-chan T) T {
 	t.Helper()
 	select {
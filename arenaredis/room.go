@@ -0,0 +1,79 @@
+package arenaredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+var (
+	// getRoomScript returns the state of a room, or nil if the room does not exist.
+	getRoomScript = newLuaScript(`
+local fleet = load_fleets({ARGV[1]})[1]
+local room_id = ARGV[2]
+reap_expired_reservations(fleet)
+local container_id = redis.call('GET', fleet.room_container_prefix .. room_id)
+if not container_id then
+    return nil
+end
+local room = redis.call('HMGET', fleet.room_prefix .. room_id, 'state', 'allocated_at', 'allocation_event')
+return cjson.encode({
+    container_id = container_id,
+    state = room[1] or nil,
+    allocated_at_ms = tonumber(room[2]),
+    allocation_event = room[3] or nil,
+    now_ms = now_ms(),
+    container_alive = redis.call('EXISTS', fleet.heartbeat_prefix .. container_id) == 1,
+})
+`)
+)
+
+func (a *redisFrontend) GetRoom(ctx context.Context, req arena.GetRoomRequest) (*arena.GetRoomResponse, error) {
+	if req.RoomID == "" {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room id"))
+	}
+	fleetName, err := a.resolveRoomFleet(ctx, req.FleetName, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	keys := fleetScriptKeys(a.keyPrefix, fleetName)
+	data, err := getRoomScript.Exec(ctx, a.client, keys, []string{fleetName, req.RoomID}).ToString()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return nil, arena.NewError(arena.ErrorStatusNotFound, fmt.Errorf("room %s not found in fleet %s", req.RoomID, fleetName))
+		}
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to get room: %w", err))
+	}
+	result, err := decodeGetRoomScriptResult(data)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+
+	resp := &arena.GetRoomResponse{
+		RoomID:         req.RoomID,
+		ContainerID:    result.ContainerID,
+		FleetName:      fleetName,
+		State:          arena.RoomState(result.State),
+		ContainerAlive: result.ContainerAlive,
+	}
+	// Rooms allocated by an older version have no allocation time nor allocation event
+	if result.AllocatedAtMs > 0 {
+		resp.AllocatedAt = time.UnixMilli(result.AllocatedAtMs)
+		resp.Age = time.Duration(result.NowMs-result.AllocatedAtMs) * time.Millisecond
+	}
+	if result.AllocationEvent != "" {
+		event, err := decodeToContainerEvent(result.AllocationEvent)
+		if err != nil {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+		}
+		if allocationEvent, ok := event.(*arena.AllocationEvent); ok {
+			resp.RoomInitialData = allocationEvent.RoomInitialData
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,454 @@
+package arenaredis
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+const (
+	defaultSearchRoomsLimit = 100
+	// searchRoomsScanCount is the number of rooms read from Redis at once, so that a search does not block Redis.
+	searchRoomsScanCount    = 500
+	roomPropertyFieldPrefix = "property:"
+)
+
+// SearchRooms reads the candidate rooms from an index in batches and filters them in the Frontend.
+// With an '=' or range filter, the candidates are the rooms in the index of the most selective one
+// (the rooms with the value, or the rooms with the numeric property in the range), which are sorted in the Frontend.
+// Otherwise, or if the most selective one is a range of SortBy, the rooms are read in the order of the search
+// from the index of SortBy (or of all the rooms with properties) only until the page is filled.
+func (a *redisFrontend) SearchRooms(ctx context.Context, req arena.SearchRoomsRequest) (*arena.SearchRoomsResponse, error) {
+	if err := validateSearchRoomsRequest(req); err != nil {
+		return nil, err
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultSearchRoomsLimit
+	}
+	after, err := decodeRoomSearchCursor(req.Cursor)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusInvalidRequest, err)
+	}
+	var last *arena.RoomSearchResult
+	if after != nil {
+		last = &arena.RoomSearchResult{RoomID: after.RoomID, Properties: map[string]string{}}
+		if after.SortValue != nil {
+			last.Properties[req.SortBy] = *after.SortValue
+		}
+	}
+	compare := func(x, y arena.RoomSearchResult) int {
+		return compareRoomSearchResults(x, y, req.SortBy, req.Descending)
+	}
+	accept := func(room arena.RoomSearchResult) bool {
+		return matchRoomProperties(room.Properties, req.Filters) && (last == nil || compare(room, *last) > 0)
+	}
+
+	index, err := a.selectiveSearchIndex(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var rooms []arena.RoomSearchResult
+	switch {
+	case index != nil && index.name == "":
+		rooms, err = a.searchRoomSet(ctx, req.FleetName, index.key, accept)
+		slices.SortFunc(rooms, compare)
+	case index != nil && index.name != req.SortBy:
+		rooms, err = a.searchIndexInOrder(ctx, req.FleetName, nil, math.MaxInt, func(offset int64) rueidis.Completed {
+			return a.client.B().Zrange().Key(index.key).Min(index.min).Max(index.max).Byscore().Limit(offset, searchRoomsScanCount).Build()
+		}, accept)
+		slices.SortFunc(rooms, compare)
+	default:
+		rooms, err = a.searchRoomsInOrder(ctx, req, index, limit+1, last, accept)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &arena.SearchRoomsResponse{Rooms: rooms}
+	if len(rooms) > limit {
+		resp.Rooms = rooms[:limit]
+		last := resp.Rooms[limit-1]
+		next := roomSearchCursor{RoomID: last.RoomID}
+		if value := last.Properties[req.SortBy]; isRoomPropertyNumber(value) {
+			next.SortValue = &value
+		}
+		resp.NextCursor = encodeRoomSearchCursor(next)
+	}
+	return resp, nil
+}
+
+// roomSearchIndex is an index of the rooms that can match a search.
+type roomSearchIndex struct {
+	// name is the property of the index of a numeric property, or empty for the set of the rooms with a value
+	name string
+	key  string
+	// min and max are the range of the scores to read from the index of a numeric property
+	min, max string
+}
+
+// selectiveSearchIndex returns the index with the fewest candidates among the indexes of the '=' filters
+// (the rooms with the value) and of the range filters (the rooms with the property in the range),
+// or nil if the search has neither.
+func (a *redisFrontend) selectiveSearchIndex(ctx context.Context, req arena.SearchRoomsRequest) (*roomSearchIndex, error) {
+	var indexes []*roomSearchIndex
+	ranges := map[string]*scoreRange{}
+	for _, filter := range req.Filters {
+		switch filter.Operator {
+		case arena.RoomPropertyOpEqual:
+			indexes = append(indexes, &roomSearchIndex{key: redisKeyRoomPropertyValue(a.keyPrefix, req.FleetName, filter.Key, filter.Value)})
+		case arena.RoomPropertyOpNotEqual:
+		default:
+			r, ok := ranges[filter.Key]
+			if !ok {
+				r = &scoreRange{min: math.Inf(-1), max: math.Inf(1)}
+				ranges[filter.Key] = r
+			}
+			// the filter value has been validated as a number
+			value, _ := parseRoomPropertyNumber(filter.Value)
+			r.narrow(filter.Operator, value)
+		}
+	}
+	for name, r := range ranges {
+		indexes = append(indexes, &roomSearchIndex{name: name, key: redisKeyRoomPropertyNumbers(a.keyPrefix, req.FleetName, name),
+			min: formatScore(r.min, r.minExclusive), max: formatScore(r.max, r.maxExclusive)})
+	}
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+	cmds := make(rueidis.Commands, 0, len(indexes))
+	for _, index := range indexes {
+		if index.name == "" {
+			cmds = append(cmds, a.client.B().Scard().Key(index.key).Build())
+		} else {
+			cmds = append(cmds, a.client.B().Zcount().Key(index.key).Min(index.min).Max(index.max).Build())
+		}
+	}
+	var best *roomSearchIndex
+	fewest := int64(-1)
+	for i, res := range a.client.DoMulti(ctx, cmds...) {
+		count, err := res.AsInt64()
+		if err != nil {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to count candidate rooms: %w", err))
+		}
+		if fewest < 0 || count < fewest {
+			best, fewest = indexes[i], count
+		}
+	}
+	return best, nil
+}
+
+// searchRoomSet reads all the rooms of a set in batches and returns the rooms accepted.
+func (a *redisFrontend) searchRoomSet(ctx context.Context, fleetName, key string, accept func(arena.RoomSearchResult) bool) ([]arena.RoomSearchResult, error) {
+	seen := map[string]struct{}{}
+	var rooms []arena.RoomSearchResult
+	var cursor uint64
+	for {
+		cmd := a.client.B().Sscan().Key(key).Cursor(cursor).Count(searchRoomsScanCount).Build()
+		entry, err := a.client.Do(ctx, cmd).AsScanEntry()
+		if err != nil {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to sscan searchable rooms: %w", err))
+		}
+		// SSCAN may return a room more than once
+		var roomIDs []string
+		for _, roomID := range entry.Elements {
+			if _, ok := seen[roomID]; !ok {
+				seen[roomID] = struct{}{}
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		found, err := a.getSearchableRooms(ctx, fleetName, roomIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, room := range found {
+			if accept(room) {
+				rooms = append(rooms, room)
+			}
+		}
+		cursor = entry.Cursor
+		if cursor == 0 {
+			return rooms, nil
+		}
+	}
+}
+
+// searchRoomsInOrder reads the rooms in the order of the search until n rooms are accepted:
+// the rooms in the index of SortBy (only in the range of index if given) in order of the property,
+// and then the other rooms with properties in order of room ID, unless index excludes them.
+func (a *redisFrontend) searchRoomsInOrder(ctx context.Context, req arena.SearchRoomsRequest, index *roomSearchIndex, n int, last *arena.RoomSearchResult, accept func(arena.RoomSearchResult) bool) ([]arena.RoomSearchResult, error) {
+	var rooms []arena.RoomSearchResult
+	var err error
+	lastValue, lastNumbered := "", false
+	if last != nil {
+		lastValue = last.Properties[req.SortBy]
+		lastNumbered = isRoomPropertyNumber(lastValue)
+	}
+	if req.SortBy != "" && (last == nil || lastNumbered) {
+		sorted := index
+		if sorted == nil {
+			sorted = &roomSearchIndex{name: req.SortBy, key: redisKeyRoomPropertyNumbers(a.keyPrefix, req.FleetName, req.SortBy), min: "-inf", max: "+inf"}
+		}
+		minScore, maxScore := sorted.min, sorted.max
+		if lastNumbered {
+			// The rooms of the same value as the cursor are skipped by accept
+			if req.Descending {
+				maxScore = lastValue
+			} else {
+				minScore = lastValue
+			}
+		}
+		rooms, err = a.searchIndexInOrder(ctx, req.FleetName, rooms, n, func(offset int64) rueidis.Completed {
+			if req.Descending {
+				// ZRANGE BYSCORE REV takes the maximum first
+				return a.client.B().Zrange().Key(sorted.key).Min(maxScore).Max(minScore).Byscore().Rev().Limit(offset, searchRoomsScanCount).Build()
+			}
+			return a.client.B().Zrange().Key(sorted.key).Min(minScore).Max(maxScore).Byscore().Limit(offset, searchRoomsScanCount).Build()
+		}, accept)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rooms) >= n || index != nil {
+		// A range filter on SortBy excludes the rooms without a numeric SortBy property
+		return rooms, nil
+	}
+	start := "-"
+	if last != nil && !lastNumbered {
+		start = "(" + last.RoomID
+	}
+	return a.searchIndexInOrder(ctx, req.FleetName, rooms, n, func(offset int64) rueidis.Completed {
+		return a.client.B().Zrange().Key(redisKeySearchableRooms(a.keyPrefix, req.FleetName)).Min(start).Max("+").Bylex().Limit(offset, searchRoomsScanCount).Build()
+	}, func(room arena.RoomSearchResult) bool {
+		// The rooms with a numeric SortBy property have been read in order of it
+		return (req.SortBy == "" || !isRoomPropertyNumber(room.Properties[req.SortBy])) && accept(room)
+	})
+}
+
+// searchIndexInOrder reads the rooms of a sorted set in batches by the command of read,
+// appending the rooms accepted to rooms until it has n rooms or the sorted set is exhausted.
+func (a *redisFrontend) searchIndexInOrder(ctx context.Context, fleetName string, rooms []arena.RoomSearchResult, n int, read func(offset int64) rueidis.Completed, accept func(arena.RoomSearchResult) bool) ([]arena.RoomSearchResult, error) {
+	for offset := int64(0); len(rooms) < n; {
+		roomIDs, err := a.client.Do(ctx, read(offset)).AsStrSlice()
+		if err != nil {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to read searchable rooms: %w", err))
+		}
+		found, err := a.getSearchableRooms(ctx, fleetName, roomIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, room := range found {
+			if len(rooms) < n && accept(room) {
+				rooms = append(rooms, room)
+			}
+		}
+		offset += int64(len(roomIDs))
+		if len(roomIDs) < searchRoomsScanCount {
+			break
+		}
+	}
+	return rooms, nil
+}
+
+// scoreRange is a range of the scores of a sorted set, narrowed by the range filters.
+type scoreRange struct {
+	min, max                   float64
+	minExclusive, maxExclusive bool
+}
+
+func (r *scoreRange) narrow(operator arena.RoomPropertyOperator, value float64) {
+	switch operator {
+	case arena.RoomPropertyOpGreaterThan, arena.RoomPropertyOpGreaterThanOrEqual:
+		exclusive := operator == arena.RoomPropertyOpGreaterThan
+		if value > r.min || (value == r.min && exclusive) {
+			r.min, r.minExclusive = value, exclusive
+		}
+	case arena.RoomPropertyOpLessThan, arena.RoomPropertyOpLessThanOrEqual:
+		exclusive := operator == arena.RoomPropertyOpLessThan
+		if value < r.max || (value == r.max && exclusive) {
+			r.max, r.maxExclusive = value, exclusive
+		}
+	}
+}
+
+// formatScore returns a bound of ZRANGE BYSCORE.
+func formatScore(score float64, exclusive bool) string {
+	s := strconv.FormatFloat(score, 'g', -1, 64)
+	switch {
+	case math.IsInf(score, 1):
+		s = "+inf"
+	case math.IsInf(score, -1):
+		s = "-inf"
+	}
+	if exclusive {
+		return "(" + s
+	}
+	return s
+}
+
+// getSearchableRooms returns the allocated rooms with their properties, skipping the rooms released or reserved.
+func (a *redisFrontend) getSearchableRooms(ctx context.Context, fleetName string, roomIDs []string) ([]arena.RoomSearchResult, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	cmds := make(rueidis.Commands, 0, len(roomIDs)*2)
+	for _, roomID := range roomIDs {
+		cmds = append(cmds,
+			a.client.B().Get().Key(redisKeyRoomToContainer(a.keyPrefix, fleetName, roomID)).Build(),
+			a.client.B().Hgetall().Key(redisKeyRoom(a.keyPrefix, fleetName, roomID)).Build())
+	}
+	results := a.client.DoMulti(ctx, cmds...)
+	var rooms []arena.RoomSearchResult
+	for i, roomID := range roomIDs {
+		containerID, err := results[i*2].ToString()
+		if err != nil {
+			if rueidis.IsRedisNil(err) {
+				continue
+			}
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to get container of room '%s': %w", roomID, err))
+		}
+		fields, err := results[i*2+1].AsStrMap()
+		if err != nil {
+			return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to get room '%s': %w", roomID, err))
+		}
+		if fields["state"] != string(arena.RoomStateAllocated) {
+			continue
+		}
+		room := arena.RoomSearchResult{RoomID: roomID, ContainerID: containerID, Properties: map[string]string{}}
+		for field, value := range fields {
+			if name, ok := strings.CutPrefix(field, roomPropertyFieldPrefix); ok {
+				room.Properties[name] = value
+			}
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+func matchRoomProperties(properties map[string]string, filters []arena.RoomPropertyFilter) bool {
+	for _, filter := range filters {
+		value, ok := properties[filter.Key]
+		if !ok {
+			if filter.Operator == arena.RoomPropertyOpNotEqual {
+				continue
+			}
+			return false
+		}
+		switch filter.Operator {
+		case arena.RoomPropertyOpEqual:
+			if value != filter.Value {
+				return false
+			}
+		case arena.RoomPropertyOpNotEqual:
+			if value == filter.Value {
+				return false
+			}
+		default:
+			x, ok := parseRoomPropertyNumber(value)
+			if !ok {
+				return false
+			}
+			// the filter value has been validated as a number
+			y, _ := parseRoomPropertyNumber(filter.Value)
+			c := cmp.Compare(x, y)
+			switch filter.Operator {
+			case arena.RoomPropertyOpLessThan:
+				ok = c < 0
+			case arena.RoomPropertyOpLessThanOrEqual:
+				ok = c <= 0
+			case arena.RoomPropertyOpGreaterThan:
+				ok = c > 0
+			case arena.RoomPropertyOpGreaterThanOrEqual:
+				ok = c >= 0
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareRoomSearchResults compares two rooms in the order of SearchRooms: the rooms with a numeric SortBy property
+// in order of it (ties are broken by room ID in the same order), followed by the others in order of room ID.
+func compareRoomSearchResults(x, y arena.RoomSearchResult, sortBy string, descending bool) int {
+	if sortBy != "" {
+		xv, xok := parseRoomPropertyNumber(x.Properties[sortBy])
+		yv, yok := parseRoomPropertyNumber(y.Properties[sortBy])
+		switch {
+		case xok && yok:
+			c := cmp.Or(cmp.Compare(xv, yv), strings.Compare(x.RoomID, y.RoomID))
+			if descending {
+				return -c
+			}
+			return c
+		case xok:
+			return -1
+		case yok:
+			return 1
+		}
+	}
+	return strings.Compare(x.RoomID, y.RoomID)
+}
+
+// roomPropertyNumberPattern matches a decimal number. Other notations accepted by strconv.ParseFloat
+// (e.g. "inf" or hexadecimal) are not regarded as numbers, so that they are treated the same as in Lua.
+var roomPropertyNumberPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// parseRoomPropertyNumber returns a property value as a number if it is a decimal number.
+// See is_property_number in Lua.
+func parseRoomPropertyNumber(value string) (float64, bool) {
+	if !roomPropertyNumberPattern.MatchString(value) {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	return number, err == nil
+}
+
+func isRoomPropertyNumber(value string) bool {
+	_, ok := parseRoomPropertyNumber(value)
+	return ok
+}
+
+func validateRoomProperties(properties map[string]string) error {
+	for name := range properties {
+		if name == "" {
+			return errors.New("missing room property name")
+		}
+	}
+	return nil
+}
+
+func validateSearchRoomsRequest(req arena.SearchRoomsRequest) error {
+	if req.FleetName == "" {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing fleet name"))
+	}
+	if req.Limit < 0 {
+		return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("invalid limit: %d", req.Limit))
+	}
+	for _, filter := range req.Filters {
+		if filter.Key == "" {
+			return arena.NewError(arena.ErrorStatusInvalidRequest, errors.New("missing room property filter key"))
+		}
+		switch filter.Operator {
+		case arena.RoomPropertyOpEqual, arena.RoomPropertyOpNotEqual:
+		case arena.RoomPropertyOpLessThan, arena.RoomPropertyOpLessThanOrEqual, arena.RoomPropertyOpGreaterThan, arena.RoomPropertyOpGreaterThanOrEqual:
+			if !isRoomPropertyNumber(filter.Value) {
+				return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("room property filter operator '%s' requires a number: '%s'", filter.Operator, filter.Value))
+			}
+		default:
+			return arena.NewError(arena.ErrorStatusInvalidRequest, fmt.Errorf("unknown room property filter operator '%s'", filter.Operator))
+		}
+	}
+	return nil
+}
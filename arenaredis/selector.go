@@ -0,0 +1,190 @@
+package arenaredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/rueidis"
+
+	"github.com/castaneai/arena"
+)
+
+const (
+	// defaultContainerSelectorMaxAttempts is how many times the selection is retried
+	// when the selected containers have changed before the allocation is committed.
+	defaultContainerSelectorMaxAttempts = 5
+)
+
+var (
+	// snapshotContainerCandidatesScript returns the containers that can host the room, with their state.
+	// The candidates of each fleet (and region, see search_order) are read page by page as find_container does,
+	// until req.candidate_count candidates are found, the end of the index is reached
+	// or req.scan_limit containers (if set) have been scanned.
+	// It returns nil if there is no candidate.
+	snapshotContainerCandidatesScript = newLuaScript(`
+local req = cjson.decode(ARGV[1])
+local fleets = load_fleets(req.fleet_names)
+for _, fleet in ipairs(fleets) do
+    clean_up_fleet(fleet)
+end
+local candidates = {}
+local seen = {}
+for _, target in ipairs(search_order(fleets, req)) do
+    local fleet = target.fleet
+    req.region = target.region
+    local taken = 0
+    local offset = 0
+    while taken < req.candidate_count and not (req.scan_limit and offset >= req.scan_limit) do
+        local count = req.candidate_count
+        if req.scan_limit then
+            count = math.min(count, req.scan_limit - offset)
+        end
+        local found = redis.call('ZRANGE', fleet.available_containers_key, '(0', '+inf', 'BYSCORE', 'LIMIT', offset, count)
+        offset = offset + #found
+        for _, container_id in ipairs(found) do
+            if taken < req.candidate_count and not seen[fleet.name .. ':' .. container_id] and can_host(fleet, container_id, req) then
+                seen[fleet.name .. ':' .. container_id] = true
+                taken = taken + 1
+                local labels = {}
+                local fields = redis.call('HGETALL', fleet.container_labels_prefix .. container_id)
+                for i = 1, #fields, 2 do
+                    labels[fields[i]] = fields[i + 1]
+                end
+                local resources = {}
+                fields = redis.call('HGETALL', fleet.container_resources_prefix .. container_id)
+                for i = 1, #fields, 2 do
+                    resources[fields[i]] = tonumber(fields[i + 1])
+                end
+                local topology_key = fleet.container_topology_prefix .. container_id
+                table.insert(candidates, {
+                    fleet_name = fleet.name,
+                    container_id = container_id,
+                    capacity = tonumber(redis.call('ZSCORE', fleet.available_containers_key, container_id)),
+                    room_count = redis.call('SCARD', fleet.container_to_rooms_prefix .. container_id),
+                    -- Empty tables are omitted because they may be encoded as JSON arrays
+                    labels = next(labels) and labels or nil,
+                    resources = next(resources) and resources or nil,
+                    region = container_region(fleet, container_id),
+                    zone = redis.call('HGET', topology_key, 'zone') or '',
+                    host = redis.call('HGET', topology_key, 'host') or '',
+                })
+            end
+        end
+        if #found < count then
+            break
+        end
+    end
+end
+if #candidates == 0 then
+    return nil
+end
+return cjson.encode(candidates)
+`)
+)
+
+// ContainerSelector chooses the container to host a room in Go, instead of the allocation strategy of the Frontend.
+// The Frontend takes a snapshot of the candidate containers, asks the ContainerSelector to rank them,
+// and commits the allocation to the first ranked container that still can host the room.
+// If a ranked container has changed since the snapshot, the selection is retried with a new snapshot.
+type ContainerSelector interface {
+	// SelectContainers returns the candidates to allocate the room to, in order of preference.
+	// Candidates that are not returned are never chosen.
+	SelectContainers(ctx context.Context, req arena.AllocateRoomRequest, candidates []ContainerCandidate) []ContainerCandidate
+}
+
+// ContainerSelectorFunc is an adapter to use an ordinary function as ContainerSelector.
+type ContainerSelectorFunc func(ctx context.Context, req arena.AllocateRoomRequest, candidates []ContainerCandidate) []ContainerCandidate
+
+func (f ContainerSelectorFunc) SelectContainers(ctx context.Context, req arena.AllocateRoomRequest, candidates []ContainerCandidate) []ContainerCandidate {
+	return f(ctx, req, candidates)
+}
+
+// ContainerCandidate is a container that can host the room, as of the snapshot.
+type ContainerCandidate struct {
+	ContainerID string
+	FleetName   string
+	// Capacity is the number of rooms the container can still host.
+	Capacity int
+	// RoomCount is the number of rooms allocated to the container.
+	RoomCount int
+	Labels    map[string]string
+	// Resources are the amounts of the named resources left.
+	Resources map[string]int
+	// Topology is the location of the container. Its Region is the fleet name if the container has no region.
+	Topology arena.ContainerTopology
+}
+
+// WithContainerSelector sets the ContainerSelector to choose the container in Go.
+// AllocateRoomRequest.Strategy, PreferredZones, PreferredContainerID, AffinityKey and WithTopCandidates are not used with it,
+// while the other conditions (e.g. LabelSelector and Resources) are still enforced.
+// If no container can host the room in the snapshot, the ContainerSelector is not consulted
+// and the room is allocated as without it: a room of lower priority may be preempted (see AllocateRoomRequest.Priority),
+// and Error with code ErrorStatusUnsatisfiable is returned if the anti-affinity cannot be satisfied.
+// ExplainAllocation does not consult the ContainerSelector.
+func WithContainerSelector(selector ContainerSelector) RedisFrontendOption {
+	return redisFrontendOptionFunc(func(options *redisFrontendOptions) {
+		options.containerSelector = selector
+	})
+}
+
+func (a *redisFrontend) allocateRoomWithSelector(ctx context.Context, req arena.AllocateRoomRequest, scriptReq allocateRoomScriptRequest) (*allocateRoomScriptResult, error) {
+	for range defaultContainerSelectorMaxAttempts {
+		candidates, err := a.snapshotContainerCandidates(ctx, scriptReq)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidates) == 0 {
+			// Nothing to select; preempt or tell why as without the ContainerSelector
+			return a.execAllocateRoomScript(ctx, req, scriptReq)
+		}
+		scriptReq.UseSelected = true
+		scriptReq.Selected = nil
+		for _, selected := range a.options.containerSelector.SelectContainers(ctx, req, candidates) {
+			scriptReq.Selected = append(scriptReq.Selected, selectedContainerJSON{
+				FleetName:   selected.FleetName,
+				ContainerID: selected.ContainerID,
+				Capacity:    selected.Capacity,
+			})
+		}
+		result, err := a.execAllocateRoomScript(ctx, req, scriptReq)
+		if err != nil {
+			return nil, err
+		}
+		if !result.Conflict {
+			return result, nil
+		}
+	}
+	return nil, arena.NewError(arena.ErrorStatusResourceExhausted, fmt.Errorf("selected containers kept changing after %d attempts", defaultContainerSelectorMaxAttempts))
+}
+
+func (a *redisFrontend) snapshotContainerCandidates(ctx context.Context, scriptReq allocateRoomScriptRequest) ([]ContainerCandidate, error) {
+	encodedReq, err := encodeAllocateRoomScriptRequest(scriptReq)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to encode allocation request: %w", err))
+	}
+	res := snapshotContainerCandidatesScript.Exec(ctx, a.client, multiFleetScriptKeys(a.keyPrefix, scriptReq.FleetNames), []string{encodedReq})
+	data, err := res.ToString()
+	if err != nil {
+		if rueidis.IsRedisNil(err) {
+			return nil, nil
+		}
+		return nil, arena.NewError(arena.ErrorStatusUnknown, fmt.Errorf("failed to take snapshot of container candidates: %w", err))
+	}
+	candidatesJSON, err := decodeContainerCandidates(data)
+	if err != nil {
+		return nil, arena.NewError(arena.ErrorStatusUnknown, err)
+	}
+	candidates := make([]ContainerCandidate, 0, len(candidatesJSON))
+	for _, c := range candidatesJSON {
+		candidates = append(candidates, ContainerCandidate{
+			ContainerID: c.ContainerID,
+			FleetName:   c.FleetName,
+			Capacity:    c.Capacity,
+			RoomCount:   c.RoomCount,
+			Labels:      c.Labels,
+			Resources:   c.Resources,
+			Topology:    arena.ContainerTopology{Region: c.Region, Zone: c.Zone, Host: c.Host},
+		})
+	}
+	return candidates, nil
+}
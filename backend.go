@@ -21,15 +21,48 @@ type Backend interface {
 
 	// SendHeartbeat sends a heartbeat to keep the container alive.
 	SendHeartbeat(ctx context.Context, req SendHeartbeatRequest) error
+
+	// AckAllocation acknowledges that the container has processed the AllocationEvent of a room.
+	// If the allocation has already been rolled back (e.g. the ack came too late),
+	// Error is returned with code: ErrorStatusNotFound, and the container should discard the room.
+	AckAllocation(ctx context.Context, req AckAllocationRequest) error
+
+	// SetRoomProperties updates the searchable properties of a room (e.g. the number of open slots); see Frontend.SearchRooms.
+	// The properties are merged into the current ones, and a property with an empty value is removed.
+	// If the room is not allocated to the container, Error is returned with code: ErrorStatusNotFound.
+	SetRoomProperties(ctx context.Context, req SetRoomPropertiesRequest) error
 }
 
 type AddContainerRequest struct {
 	ContainerID     string
 	FleetName       string
 	InitialCapacity int
-	HeartbeatTTL    time.Duration // TTL for heartbeat, uses DefaultHeartbeatTTL if 0
+	HeartbeatTTL    time.Duration     // TTL for heartbeat, uses DefaultHeartbeatTTL if 0
+	Labels          map[string]string // Labels used by AllocateRoomRequest.LabelSelector
+	// Resources declares the capacity of named resources (e.g. "gpu_mem_mb": 24000) in addition to InitialCapacity.
+	// Each room consumes the amount declared in AllocateRoomRequest.Resources.
+	Resources map[string]int
+	// Topology is where the container runs.
+	// It is used by AllocateRoomRequest.PreferredZones and AntiAffinityTopologyKey (see TopologyKeyHost).
+	Topology ContainerTopology
+}
+
+// ContainerTopology is the location of a container.
+type ContainerTopology struct {
+	Region string
+	Zone   string
+	Host   string
 }
 
+// Well-known topology keys for AllocateRoomRequest.AntiAffinityTopologyKey, resolved to ContainerTopology
+// instead of a container label.
+const (
+	// TopologyKeyHost spreads the rooms across ContainerTopology.Host.
+	TopologyKeyHost = "topology/host"
+	// TopologyKeyZone spreads the rooms across ContainerTopology.Zone.
+	TopologyKeyZone = "topology/zone"
+)
+
 type AddContainerResponse struct {
 	EventChannel <-chan ToContainerEvent
 }
@@ -52,6 +85,25 @@ type NotifyToRoomEvent struct {
 
 func (e *NotifyToRoomEvent) toContainerEvent() {}
 
+// RoomPreemptedEvent tells that a room has been preempted by a room of higher priority.
+// The container should stop the room and call Backend.ReleaseRoom within GracePeriod.
+// The room keeps its slot until then; once it is released (or GracePeriod has passed, when it is released anyway),
+// the slot goes to the other room, whose AllocationEvent follows.
+type RoomPreemptedEvent struct {
+	RoomID      string
+	GracePeriod time.Duration
+}
+
+func (e *RoomPreemptedEvent) toContainerEvent() {}
+
+// RoomDeallocatedEvent tells that a room has been released by Frontend.DeallocateRoom.
+// The container should tear the room down; it does not need to call Backend.ReleaseRoom.
+type RoomDeallocatedEvent struct {
+	RoomID string
+}
+
+func (e *RoomDeallocatedEvent) toContainerEvent() {}
+
 type DeleteContainerRequest struct {
 	ContainerID string
 	FleetName   string
@@ -67,3 +119,16 @@ type SendHeartbeatRequest struct {
 	ContainerID string
 	FleetName   string
 }
+
+type AckAllocationRequest struct {
+	ContainerID string
+	FleetName   string
+	RoomID      string
+}
+
+type SetRoomPropertiesRequest struct {
+	ContainerID string
+	FleetName   string
+	RoomID      string
+	Properties  map[string]string
+}
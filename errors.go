@@ -12,6 +12,8 @@ const (
 	ErrorStatusNotFound          ErrorStatus = "not_found"
 	ErrorStatusResourceExhausted ErrorStatus = "resource_exhausted"
 	ErrorStatusInvalidRequest    ErrorStatus = "invalid_request"
+	// ErrorStatusUnsatisfiable means that no container satisfies the placement rules of the request (e.g. anti-affinity).
+	ErrorStatusUnsatisfiable ErrorStatus = "unsatisfiable"
 )
 
 type Error struct {
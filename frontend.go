@@ -2,31 +2,374 @@ package arena
 
 import (
 	"context"
+	"time"
 )
 
 type Frontend interface {
 	// AllocateRoom searches for an available containers and allocates a Room.
-	// If there is no vacancy, it returns Error with code: ErrorStatusResourceExhausted.
+	// If the Room has already been allocated, it returns the Room as is.
+	// If the Room has been reserved by ReserveRoom, Error is returned with code: ErrorStatusInvalidRequest.
+	// If there is no vacancy, a Room of lower AllocateRoomRequest.Priority is preempted to make room for it.
+	// If there is none, it returns Error with code: ErrorStatusResourceExhausted,
+	// unless AllocateRoomRequest.WaitForCapacity is set.
 	AllocateRoom(ctx context.Context, req AllocateRoomRequest) (*AllocateRoomResponse, error)
 
+	// ExplainAllocation tells which container AllocateRoom would choose for the request and why the other candidates
+	// were rejected, without changing anything (dry run).
+	// Expired reservations and preempted rooms past their grace period are regarded as released, as AllocateRoom does,
+	// and the room that would be preempted is reported if no container has vacancy.
+	ExplainAllocation(ctx context.Context, req AllocateRoomRequest) (*ExplainAllocationResponse, error)
+
+	// AllocateRooms allocates multiple Rooms atomically: either all of them are allocated or none.
+	// If any of the rooms cannot be placed, it returns Error with code: ErrorStatusResourceExhausted,
+	// or ErrorStatusUnsatisfiable if the anti-affinity rule of the room (see AllocateRoomRequest.AntiAffinityGroup) cannot be satisfied.
+	// If all the rooms have already been allocated (e.g. a retry), it returns them as is;
+	// if only some of them have, Error is returned with code: ErrorStatusInvalidRequest.
+	AllocateRooms(ctx context.Context, req AllocateRoomsRequest) (*AllocateRoomsResponse, error)
+
 	// NotifyToRoom sends a message to a Room.
 	// If the room does not exist, Error is returned with code: ErrorStatusNotFound.
 	NotifyToRoom(ctx context.Context, req NotifyToRoomRequest) error
+
+	// DeallocateRoom releases a Room on behalf of its container (e.g. the match was cancelled)
+	// and sends RoomDeallocatedEvent to the container so that it tears the room down.
+	// If the room does not exist, Error is returned with code: ErrorStatusNotFound.
+	DeallocateRoom(ctx context.Context, req DeallocateRoomRequest) error
+
+	// GetRoom returns the current state of a Room (e.g. to check that it is still alive before routing players to it).
+	// If the room does not exist, Error is returned with code: ErrorStatusNotFound.
+	GetRoom(ctx context.Context, req GetRoomRequest) (*GetRoomResponse, error)
+
+	// SearchRooms returns the allocated Rooms of a fleet whose properties match the filters (e.g. for lobby browsing).
+	// Only the Rooms with properties (see AllocateRoomRequest.Properties and Backend.SetRoomProperties) are searched.
+	// Without a RoomPropertyOpEqual or range filter, each page reads the Rooms in order (of SortBy, or RoomID)
+	// only until it is filled. With one, each page reads all the Rooms matching the most selective of them,
+	// unless it is a range filter on SortBy, whose Rooms are read in order as well.
+	SearchRooms(ctx context.Context, req SearchRoomsRequest) (*SearchRoomsResponse, error)
+
+	// ReserveRoom holds a slot for a Room like AllocateRoom, but does not send AllocationEvent to the container.
+	// The reservation must be committed by CommitReservation or released by CancelReservation before the TTL.
+	// If the reservation expires, its capacity is returned to the container automatically.
+	ReserveRoom(ctx context.Context, req ReserveRoomRequest) (*ReserveRoomResponse, error)
+
+	// CommitReservation turns a reservation into an allocated Room and sends AllocationEvent to the container.
+	// If the reservation does not exist or has expired, Error is returned with code: ErrorStatusNotFound.
+	// If the container does not receive AllocationEvent (e.g. it has lost its subscription),
+	// the reservation is released and Error is returned with code: ErrorStatusResourceExhausted.
+	CommitReservation(ctx context.Context, req CommitReservationRequest) error
+
+	// CancelReservation releases a reservation and returns its capacity to the container.
+	// If the reservation does not exist or has expired, Error is returned with code: ErrorStatusNotFound.
+	CancelReservation(ctx context.Context, req CancelReservationRequest) error
 }
 
+const (
+	DefaultReservationTTL = 10 * time.Second
+)
+
 type AllocateRoomRequest struct {
 	RoomID          string
 	FleetName       string
 	RoomInitialData []byte
+	// FallbackFleetNames are tried in order when FleetName has no vacancy.
+	// All fleets are tried atomically in a single AllocateRoom call,
+	// and the fleet used is reported by AllocateRoomResponse.FleetName.
+	FallbackFleetNames []string
+	// LabelSelector restricts the allocation to containers whose labels match.
+	// If empty, any container in the fleet can be selected.
+	LabelSelector LabelSelector
+	// Resources declares the amount of named resources the room consumes (e.g. "gpu_mem_mb": 8000).
+	// Only containers that have enough of every resource left are selected.
+	// Regardless of Resources, each room consumes 1 of the container capacity.
+	Resources map[string]int
+	// Strategy overrides the allocation strategy of the Frontend for this request.
+	// If empty, the Frontend's default strategy is used.
+	Strategy AllocationStrategy
+	// WaitForCapacity makes AllocateRoom wait in the queue of the fleet until capacity frees up,
+	// instead of failing immediately when there is no vacancy.
+	// If the context is done before the room is allocated, Error with code ErrorStatusResourceExhausted is returned.
+	WaitForCapacity bool
+	// Tenant is the key (e.g. game mode) used to share the freed capacity fairly between waiting requests.
+	// When requests of multiple tenants are waiting for capacity, slots are granted in weighted fair order
+	// instead of first come, first served. Only used with WaitForCapacity.
+	Tenant string
+	// TenantWeight is the share of the Tenant relative to other tenants. Defaults to 1 if 0.
+	TenantWeight int
+	// AckTimeout makes AllocateRoom wait until the container acknowledges the allocation by Backend.AckAllocation.
+	// If no ack arrives within the timeout, the room is rolled back and placed on another container,
+	// and the unresponsive container is excluded from allocation for a while.
+	// If 0, AllocateRoom returns without waiting for the ack. It is not used by ReserveRoom.
+	// A positive AckTimeout must be at least 1ms.
+	AckTimeout time.Duration
+	// AffinityKey co-locates related rooms (e.g. a lobby and its match).
+	// The container that already hosts a room with the same AffinityKey is preferred if it can host the room;
+	// otherwise the container is selected as usual.
+	AffinityKey string
+	// AntiAffinityGroup spreads related rooms (e.g. replicas of a world shard) across containers:
+	// a container that already hosts a room of the same group is not selected.
+	// If no container satisfies the rule, Error is returned with code: ErrorStatusUnsatisfiable.
+	AntiAffinityGroup string
+	// AntiAffinityTopologyKey is the container label key (e.g. "rack") that widens AntiAffinityGroup
+	// to all containers with the same label value, or TopologyKeyHost or TopologyKeyZone to use ContainerTopology.
+	// A container without the value is only checked by itself. If empty, the rule applies per container.
+	AntiAffinityTopologyKey string
+	// PreferredZones are the zones (see ContainerTopology) to place the room in, in order of preference.
+	// Containers in the first zone are filled first, and the room spills over to the next zone only when it is exhausted,
+	// and finally to any zone.
+	PreferredZones []string
+	// PlayerLatencies are the latencies measured by each player of the room to each region (see ContainerTopology.Region).
+	// If set, the room is placed in the region that minimizes LatencyObjective among the regions with capacity.
+	// Only the regions measured by every player are considered.
+	// A container without a region is regarded to be in the region named after its fleet.
+	PlayerLatencies []map[string]time.Duration
+	// LatencyObjective is how the latencies of the players are aggregated. Defaults to LatencyObjectiveMax.
+	LatencyObjective LatencyObjective
+	// Exclusive makes the room run alone on a container.
+	// Only a container with no room is selected, and no other room is allocated to it until the room is released.
+	Exclusive bool
+	// Priority is the priority class of the room; a higher value is more important.
+	// When no container can host the room, a room of lower priority is preempted (see RoomPreemptedEvent):
+	// the room is pending (see RoomStatePending) until the preempted room is released or its grace period has passed,
+	// and then its AllocationEvent is sent to the container; if the container does not receive it, the room is released.
+	// AckTimeout is not applied to such a room.
+	// ReserveRoom and AllocateRooms do not preempt. A reserved room is not preempted until it is committed.
+	Priority int
+	// PreferredContainerID is the container tried first (e.g. the container of the previous match for a rematch),
+	// if it is alive and can host the room; otherwise the container is selected as usual.
+	PreferredContainerID string
+	// Properties are the searchable properties of the room (e.g. "map": "desert", "open_slots": "3"); see SearchRooms.
+	// The container can update them by Backend.SetRoomProperties.
+	Properties map[string]string
 }
 
+// LatencyObjective decides the region to place a room in from the latencies of the players.
+type LatencyObjective string
+
+const (
+	// LatencyObjectiveMax minimizes the latency of the player farthest from the region.
+	LatencyObjectiveMax LatencyObjective = "max"
+	// LatencyObjectiveAverage minimizes the average latency of the players.
+	LatencyObjectiveAverage LatencyObjective = "average"
+)
+
+// AllocationStrategy decides which container is chosen among the containers with vacancy.
+type AllocationStrategy string
+
+const (
+	// AllocationStrategyPacked chooses the container with the least free capacity first (bin-packing).
+	// This keeps empty containers free so that they can be scaled down.
+	AllocationStrategyPacked AllocationStrategy = "packed"
+	// AllocationStrategyDistributed chooses the container with the most free capacity first.
+	// This spreads the load across containers.
+	AllocationStrategyDistributed AllocationStrategy = "distributed"
+	// AllocationStrategyRandom chooses a container at random.
+	AllocationStrategyRandom AllocationStrategy = "random"
+)
+
 type AllocateRoomResponse struct {
 	RoomID      string
 	ContainerID string
+	// FleetName is the fleet the room was allocated in.
+	// NotifyToRoom and ReleaseRoom must be called against this fleet.
+	FleetName string
+	// Region is the region of the container (see ContainerTopology), or the fleet name if the container has no region.
+	Region string
+	// Zone is the zone of the container (see ContainerTopology), or empty if the container has no zone.
+	Zone string
+	// PreemptedRoomID is the room of lower priority that was preempted for the room, if any.
+	// If set, the container receives the AllocationEvent of the room only after the preempted room has been released.
+	PreemptedRoomID string
+	// PreferredContainerHonored reports whether the room was allocated to AllocateRoomRequest.PreferredContainerID.
+	PreferredContainerHonored bool
+}
+
+type AllocateRoomsRequest struct {
+	// Rooms are the rooms to allocate. WaitForCapacity and AckTimeout are not supported.
+	Rooms []AllocateRoomRequest
+	// Placement constrains the containers the rooms are placed on. If empty, RoomPlacementAny is used.
+	Placement RoomPlacement
+}
+
+// RoomPlacement constrains the containers the rooms of AllocateRooms are placed on.
+type RoomPlacement string
+
+const (
+	// RoomPlacementAny places each room on any container.
+	RoomPlacementAny RoomPlacement = "any"
+	// RoomPlacementSameContainer places all the rooms on a single container.
+	// All the rooms must have the same FleetName and FallbackFleetNames.
+	RoomPlacementSameContainer RoomPlacement = "same_container"
+	// RoomPlacementDistinctContainers places each room on a different container.
+	RoomPlacementDistinctContainers RoomPlacement = "distinct_containers"
+)
+
+type AllocateRoomsResponse struct {
+	// Rooms are the allocated rooms, in the order of AllocateRoomsRequest.Rooms.
+	Rooms []AllocateRoomResponse
+}
+
+type ExplainAllocationResponse struct {
+	// ContainerID is the container the room would be allocated to, or empty if no container can host the room.
+	// With a random strategy, it is one of the possible choices.
+	ContainerID string
+	FleetName   string
+	Region      string
+	Zone        string
+	// AlreadyAllocated reports that the room has already been allocated to ContainerID.
+	AlreadyAllocated bool
+	// PreemptedRoomID is the room that would be preempted to host the room on ContainerID
+	// when no container has vacancy (see AllocateRoomRequest.Priority), if any.
+	PreemptedRoomID string
+	// Rejections are the candidates that cannot host the room, with the reason.
+	Rejections []CandidateRejection
 }
 
+type CandidateRejection struct {
+	// ContainerID is empty if the whole fleet is rejected (e.g. RejectionReasonWaitingRequests).
+	ContainerID string
+	FleetName   string
+	Reason      RejectionReason
+}
+
+// RejectionReason tells why a container cannot host a room.
+// Note that containers are never drained in arena; a container stops receiving rooms
+// when it is deleted, its heartbeat expires or it runs out of capacity.
+type RejectionReason string
+
+const (
+	RejectionReasonNoCapacity            RejectionReason = "no_capacity"
+	RejectionReasonHeartbeatMissing      RejectionReason = "heartbeat_missing"
+	RejectionReasonPenalized             RejectionReason = "penalized" // the container did not respond to allocations recently
+	RejectionReasonRegionMismatch        RejectionReason = "region_mismatch"
+	RejectionReasonLabelMismatch         RejectionReason = "label_mismatch"
+	RejectionReasonNotEmpty              RejectionReason = "not_empty" // the container has rooms but the request is Exclusive
+	RejectionReasonInsufficientResources RejectionReason = "insufficient_resources"
+	RejectionReasonAntiAffinity          RejectionReason = "anti_affinity"
+	// RejectionReasonWaitingRequests means the fleet is reserved for the requests waiting for capacity that can be placed there.
+	RejectionReasonWaitingRequests RejectionReason = "waiting_requests"
+)
+
 type NotifyToRoomRequest struct {
-	RoomID    string
+	RoomID string
+	// FleetName can be omitted if the Frontend has the global room registry (e.g. arenaredis.WithGlobalRoomRegistry).
 	FleetName string
 	Body      []byte
 }
+
+type DeallocateRoomRequest struct {
+	RoomID string
+	// FleetName can be omitted if the Frontend has the global room registry (e.g. arenaredis.WithGlobalRoomRegistry).
+	FleetName string
+}
+
+type GetRoomRequest struct {
+	RoomID string
+	// FleetName can be omitted if the Frontend has the global room registry (e.g. arenaredis.WithGlobalRoomRegistry).
+	FleetName string
+}
+
+type GetRoomResponse struct {
+	RoomID          string
+	ContainerID     string
+	FleetName       string
+	State           RoomState
+	RoomInitialData []byte
+	// AllocatedAt is the time the room was allocated (or reserved).
+	AllocatedAt time.Time
+	// Age is the time elapsed since AllocatedAt.
+	Age time.Duration
+	// ContainerAlive reports whether the heartbeat of the container has not expired.
+	ContainerAlive bool
+}
+
+// RoomState is the state of a room.
+type RoomState string
+
+const (
+	// RoomStateReserved means that the room is held by ReserveRoom and its container does not know it yet.
+	RoomStateReserved RoomState = "reserved"
+	// RoomStateAllocated means that AllocationEvent has been sent to the container.
+	RoomStateAllocated RoomState = "allocated"
+	// RoomStatePending means that the room has preempted another room (see RoomPreemptedEvent)
+	// and is sent to the container when that room is released or its grace period has passed.
+	RoomStatePending RoomState = "pending"
+)
+
+type SearchRoomsRequest struct {
+	FleetName string
+	// Filters are the conditions that the properties of a room must all match.
+	Filters []RoomPropertyFilter
+	// SortBy is the numeric property to sort the rooms by, in ascending order unless Descending is set
+	// (rooms of the same value are ordered by RoomID in the same order).
+	// Rooms whose property is missing or not a decimal number come last in order of RoomID.
+	// If empty, the rooms are sorted by RoomID.
+	SortBy     string
+	Descending bool
+	// Limit is the maximum number of rooms returned. Defaults to 100.
+	Limit int
+	// Cursor is SearchRoomsResponse.NextCursor of the previous page, or empty for the first page.
+	// The other fields must be the same as the previous page.
+	Cursor string
+}
+
+// RoomPropertyFilter is a condition on a property of a room.
+// The ordering operators compare the values as numbers, and never match a value that is not a number.
+// A room without the property matches only RoomPropertyOpNotEqual.
+type RoomPropertyFilter struct {
+	Key      string
+	Operator RoomPropertyOperator
+	Value    string
+}
+
+type RoomPropertyOperator string
+
+const (
+	RoomPropertyOpEqual              RoomPropertyOperator = "="
+	RoomPropertyOpNotEqual           RoomPropertyOperator = "!="
+	RoomPropertyOpLessThan           RoomPropertyOperator = "<"
+	RoomPropertyOpLessThanOrEqual    RoomPropertyOperator = "<="
+	RoomPropertyOpGreaterThan        RoomPropertyOperator = ">"
+	RoomPropertyOpGreaterThanOrEqual RoomPropertyOperator = ">="
+)
+
+type SearchRoomsResponse struct {
+	Rooms []RoomSearchResult
+	// NextCursor is the cursor of the next page, or empty if all the matching rooms have been returned.
+	NextCursor string
+}
+
+type RoomSearchResult struct {
+	RoomID      string
+	ContainerID string
+	Properties  map[string]string
+}
+
+type ReserveRoomRequest struct {
+	AllocateRoomRequest
+	TTL time.Duration // TTL of the reservation, uses DefaultReservationTTL if 0
+}
+
+type ReserveRoomResponse struct {
+	RoomID      string
+	ContainerID string
+	FleetName   string
+	Region      string
+	Zone        string
+	// PreferredContainerHonored reports whether the room was reserved on AllocateRoomRequest.PreferredContainerID.
+	PreferredContainerHonored bool
+	// ExpiresAt is the time the reservation expires.
+	// It is zero if the room had already been allocated (not reserved) with the same RoomID.
+	ExpiresAt time.Time
+}
+
+type CommitReservationRequest struct {
+	RoomID string
+	// FleetName can be omitted if the Frontend has the global room registry (e.g. arenaredis.WithGlobalRoomRegistry).
+	FleetName string
+}
+
+type CancelReservationRequest struct {
+	RoomID string
+	// FleetName can be omitted if the Frontend has the global room registry (e.g. arenaredis.WithGlobalRoomRegistry).
+	FleetName string
+}
@@ -0,0 +1,35 @@
+package arena
+
+// LabelSelector selects containers by their labels.
+// A container matches only if it satisfies every entry of MatchLabels and every requirement of MatchExpressions.
+// An empty LabelSelector matches all containers.
+type LabelSelector struct {
+	// MatchLabels requires the container to have each key with exactly the given value.
+	MatchLabels map[string]string
+	// MatchExpressions is a list of set-based requirements.
+	MatchExpressions []LabelSelectorRequirement
+}
+
+type LabelSelectorOperator string
+
+const (
+	// LabelSelectorOpIn requires the label value to be one of Values.
+	LabelSelectorOpIn LabelSelectorOperator = "In"
+	// LabelSelectorOpNotIn requires the label value not to be one of Values (or the label to be absent).
+	LabelSelectorOpNotIn LabelSelectorOperator = "NotIn"
+	// LabelSelectorOpExists requires the label to be present, regardless of its value.
+	LabelSelectorOpExists LabelSelectorOperator = "Exists"
+	// LabelSelectorOpDoesNotExist requires the label to be absent.
+	LabelSelectorOpDoesNotExist LabelSelectorOperator = "DoesNotExist"
+)
+
+type LabelSelectorRequirement struct {
+	Key      string
+	Operator LabelSelectorOperator
+	Values   []string
+}
+
+// IsEmpty reports whether the selector has no requirements.
+func (s LabelSelector) IsEmpty() bool {
+	return len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0
+}